@@ -0,0 +1,150 @@
+// Copyright (C) 2016, Heiko Koehler
+// aggregates of rolled up data points
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+// set of aggregates stored per data point in addition to its mean value
+type Aggregates uint8
+
+const (
+	AggMin Aggregates = 1 << iota
+	AggMax
+	AggSum
+	AggCount
+	AggLast
+)
+
+// aggregate names in storage order
+var aggregateNames = []struct {
+	agg  Aggregates
+	name string
+}{
+	{AggMin, "min"},
+	{AggMax, "max"},
+	{AggSum, "sum"},
+	{AggCount, "count"},
+	{AggLast, "last"},
+}
+
+// parse aggregate names, mean is always stored as value of data point
+// percentiles are rejected, data points only keep aggregates which can be merged when rolled up
+func ParseAggregates(names []string) (Aggregates, error) {
+	var aggs Aggregates
+
+outer:
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if name == "mean" {
+			continue
+		}
+		for _, entry := range aggregateNames {
+			if entry.name == name {
+				aggs |= entry.agg
+				continue outer
+			}
+		}
+		return 0, errors.New(fmt.Sprintf("Unknown aggregate %s", name))
+	}
+	return aggs, nil
+}
+
+// Stringer interface
+func (aggs Aggregates) String() string {
+	var names = []string{"mean"}
+
+	for _, entry := range aggregateNames {
+		if aggs&entry.agg != 0 {
+			names = append(names, entry.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// number of aggregates in set
+func (aggs Aggregates) Len() int {
+	return bits.OnesCount8(uint8(aggs))
+}
+
+// return values of aggregates in set in storage order
+func (aggs Aggregates) columns(dp DataPoint) []float64 {
+	var cols = make([]float64, 0, aggs.Len())
+
+	for _, entry := range aggregateNames {
+		if aggs&entry.agg == 0 {
+			continue
+		}
+		switch entry.agg {
+		case AggMin:
+			cols = append(cols, dp.Min)
+		case AggMax:
+			cols = append(cols, dp.Max)
+		case AggSum:
+			cols = append(cols, dp.Sum)
+		case AggCount:
+			cols = append(cols, float64(dp.Count))
+		case AggLast:
+			cols = append(cols, dp.Last)
+		}
+	}
+	return cols
+}
+
+// set aggregates of data point from values in storage order
+// aggregates not in set are derived from value of data point
+func (aggs Aggregates) setColumns(dp *DataPoint, cols []float64) {
+	dp.Min, dp.Max, dp.Sum, dp.Count, dp.Last = dp.Val, dp.Val, dp.Val, 1, dp.Val
+	for _, entry := range aggregateNames {
+		if aggs&entry.agg == 0 {
+			continue
+		}
+		switch entry.agg {
+		case AggMin:
+			dp.Min = cols[0]
+		case AggMax:
+			dp.Max = cols[0]
+		case AggSum:
+			dp.Sum = cols[0]
+		case AggCount:
+			dp.Count = uint32(cols[0])
+		case AggLast:
+			dp.Last = cols[0]
+		}
+		cols = cols[1:]
+	}
+	if aggs&AggSum == 0 {
+		dp.Sum = dp.Val * float64(dp.Count)
+	}
+}
+
+// data point as read back after storing it, i.e. aggregates not in set are derived from value
+func (aggs Aggregates) stored(dp DataPoint) DataPoint {
+	aggs.setColumns(&dp, aggs.columns(dp))
+	return dp
+}
+
+// merge data point into aggregated data point
+// time stamp of aggregated data point is kept, gaps are ignored
+func (agg *DataPoint) Merge(dp DataPoint) {
+	if dp.IsGap() {
+		return
+	}
+	if agg.Count == 0 {
+		tstamp := agg.Tstamp
+		*agg = dp
+		agg.Tstamp = tstamp
+		return
+	}
+	agg.Min = math.Min(agg.Min, dp.Min)
+	agg.Max = math.Max(agg.Max, dp.Max)
+	agg.Sum += dp.Sum
+	agg.Count += dp.Count
+	agg.Last = dp.Last
+	agg.Val = agg.Sum / float64(agg.Count)
+}
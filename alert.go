@@ -0,0 +1,296 @@
+// Copyright (C) 2016, Heiko Koehler
+// threshold alerts on handler properties
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// max number of resolved alerts kept in history
+const alertHistoryLen = 100
+
+type AlertState int
+
+const (
+	// condition not met
+	AlertInactive AlertState = iota
+	// condition met but not for long enough
+	AlertPending
+	// condition met for at least "For" duration
+	AlertFiring
+	// condition not met anymore after alert was firing
+	AlertResolved
+)
+
+func (state AlertState) String() string {
+	switch state {
+	case AlertInactive:
+		return "inactive"
+	case AlertPending:
+		return "pending"
+	case AlertFiring:
+		return "firing"
+	case AlertResolved:
+		return "resolved"
+	}
+	return fmt.Sprintf("AlertState(%d)", int(state))
+}
+
+// encode state by name, e.g. in JSON
+func (state AlertState) MarshalText() ([]byte, error) {
+	return []byte(state.String()), nil
+}
+
+// state change of an alert
+type AlertEvent struct {
+	Name      string
+	Handler   string
+	Property  string
+	Op        string
+	Threshold float64
+	State     AlertState
+	// value triggering state change
+	Value float64
+	// time alert started firing or became pending
+	Start time.Time
+	// time alert got resolved, zero while firing and omitted from JSON
+	End time.Time `json:",omitzero"`
+}
+
+// threshold alert on single property of a command handler
+type Alert struct {
+	// alert name
+	Name string
+	// path of handler owning property
+	Handler string
+	// property name
+	Property string
+	// comparison operator
+	Op string
+	// value property is compared to
+	Threshold float64
+	// how long condition must hold before alert is firing
+	For time.Duration
+	// names of notifiers to be notified on state changes
+	Notify []string
+
+	mutex sync.Mutex
+	// current state
+	State AlertState
+	// time alert became pending
+	Since time.Time
+	// time alert started firing
+	FiredAt time.Time
+	// last evaluated value
+	Value float64
+}
+
+var (
+	// all configured alerts
+	AlertRegistry = make([]*Alert, 0)
+	// recently resolved alerts in chronological order
+	AlertHistory = make([]AlertEvent, 0)
+	alertMutex   sync.Mutex
+)
+
+// create alert for property of handler at given path
+func NewAlert(handlerPath string, conf AlertConfig) (*Alert, error) {
+	var forDuration time.Duration
+
+	if _, err := compare(conf.Op, 0, 0); err != nil {
+		return nil, err
+	}
+	if conf.Name == "" {
+		return nil, errors.New("Alert without name")
+	}
+	if conf.For != "" {
+		var err error
+
+		if forDuration, err = time.ParseDuration(conf.For); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range conf.Notify {
+		if _, ok := NotifierRegistry[name]; !ok {
+			return nil, errors.New(fmt.Sprintf("Alert %s with unknown notifier %s", conf.Name, name))
+		}
+	}
+	return &Alert{Name: conf.Name, Handler: handlerPath, Property: conf.Property,
+		Op: conf.Op, Threshold: conf.Threshold, For: forDuration, Notify: conf.Notify}, nil
+}
+
+// add alert to registry
+func RegisterAlert(alert *Alert) {
+	alertMutex.Lock()
+	defer alertMutex.Unlock()
+	AlertRegistry = append(AlertRegistry, alert)
+}
+
+// remove alert from registry
+func UnregisterAlert(alert *Alert) {
+	alertMutex.Lock()
+	defer alertMutex.Unlock()
+	// registry isn't modified in place since readers iterate over it without lock
+	alerts := make([]*Alert, 0, len(AlertRegistry))
+	for _, registered := range AlertRegistry {
+		if registered != alert {
+			alerts = append(alerts, registered)
+		}
+	}
+	AlertRegistry = alerts
+}
+
+// apply comparison operator
+func compare(op string, val, threshold float64) (bool, error) {
+	switch op {
+	case "<":
+		return val < threshold, nil
+	case "<=":
+		return val <= threshold, nil
+	case ">":
+		return val > threshold, nil
+	case ">=":
+		return val >= threshold, nil
+	case "==":
+		return val == threshold, nil
+	case "!=":
+		return val != threshold, nil
+	}
+	return false, errors.New(fmt.Sprintf("Unknown alert operator \"%s\"", op))
+}
+
+// create event from current alert state
+func (alert *Alert) event() AlertEvent {
+	start := alert.FiredAt
+	if alert.State == AlertPending {
+		start = alert.Since
+	}
+	return AlertEvent{Name: alert.Name, Handler: alert.Handler, Property: alert.Property,
+		Op: alert.Op, Threshold: alert.Threshold, State: alert.State,
+		Value: alert.Value, Start: start}
+}
+
+// evaluate alert condition for newly recorded value
+func (alert *Alert) Evaluate(val float64, now time.Time) {
+	var events []AlertEvent
+
+	// missing samples neither fire nor resolve alerts
+	if math.IsNaN(val) {
+		return
+	}
+	alert.mutex.Lock()
+	cond, _ := compare(alert.Op, val, alert.Threshold)
+	alert.Value = val
+	if cond {
+		if alert.State == AlertInactive || alert.State == AlertResolved {
+			alert.State = AlertPending
+			alert.Since = now
+		}
+		if alert.State == AlertPending && now.Sub(alert.Since) >= alert.For {
+			alert.State = AlertFiring
+			alert.FiredAt = now
+			events = append(events, alert.event())
+		}
+	} else {
+		switch alert.State {
+		case AlertPending:
+			alert.State = AlertInactive
+		case AlertFiring:
+			alert.State = AlertResolved
+			ev := alert.event()
+			ev.End = now
+			events = append(events, ev)
+		}
+	}
+	alert.mutex.Unlock()
+
+	for _, ev := range events {
+		alertTransition(ev)
+		notify(alert.Notify, ev)
+	}
+}
+
+// resolve alert regardless of condition, e.g. once its property is gone
+// firing alerts are recorded as resolved and notified
+func (alert *Alert) Resolve(now time.Time) {
+	var events []AlertEvent
+
+	alert.mutex.Lock()
+	switch alert.State {
+	case AlertPending:
+		alert.State = AlertInactive
+	case AlertFiring:
+		alert.State = AlertResolved
+		ev := alert.event()
+		ev.End = now
+		events = append(events, ev)
+	}
+	alert.mutex.Unlock()
+
+	for _, ev := range events {
+		alertTransition(ev)
+		notify(alert.Notify, ev)
+	}
+}
+
+// return copy of current alert state
+func (alert *Alert) Event() AlertEvent {
+	alert.mutex.Lock()
+	defer alert.mutex.Unlock()
+	return alert.event()
+}
+
+// record alert state change
+func alertTransition(ev AlertEvent) {
+	log.Printf("Alert %s on %s/%s %s: %f %s %f\n", ev.Name, ev.Handler, ev.Property,
+		ev.State, ev.Value, ev.Op, ev.Threshold)
+	if ev.State == AlertResolved {
+		alertMutex.Lock()
+		AlertHistory = append(AlertHistory, ev)
+		if len(AlertHistory) > alertHistoryLen {
+			AlertHistory = AlertHistory[len(AlertHistory)-alertHistoryLen:]
+		}
+		alertMutex.Unlock()
+	}
+}
+
+// return state of all pending and firing alerts
+func ActiveAlerts() []AlertEvent {
+	var active = make([]AlertEvent, 0)
+
+	alertMutex.Lock()
+	alerts := AlertRegistry
+	alertMutex.Unlock()
+	for _, alert := range alerts {
+		if ev := alert.Event(); ev.State == AlertPending || ev.State == AlertFiring {
+			active = append(active, ev)
+		}
+	}
+	return active
+}
+
+// return number of firing alerts
+func FiringAlertCount() (count int) {
+	for _, ev := range ActiveAlerts() {
+		if ev.State == AlertFiring {
+			count++
+		}
+	}
+	return
+}
+
+// return resolved alerts with most recent one first
+func ResolvedAlerts() []AlertEvent {
+	alertMutex.Lock()
+	defer alertMutex.Unlock()
+	resolved := make([]AlertEvent, len(AlertHistory))
+	for i, ev := range AlertHistory {
+		resolved[len(AlertHistory)-1-i] = ev
+	}
+	return resolved
+}
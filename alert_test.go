@@ -0,0 +1,132 @@
+// Copyright (C) 2016, Heiko Koehler
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertStates(t *testing.T) {
+	alert, err := NewAlert("/test", AlertConfig{Name: "Low", Property: "Free",
+		Op: "<", Threshold: 10, For: "2m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	expect := func(val float64, offset time.Duration, state AlertState) {
+		alert.Evaluate(val, start.Add(offset))
+		if alert.State != state {
+			t.Fatalf("value %f at %v: expected state %s got %s", val, offset, state, alert.State)
+		}
+	}
+
+	expect(20, 0, AlertInactive)
+	expect(5, time.Minute, AlertPending)
+	expect(5, 2*time.Minute, AlertPending)
+	// condition doesn't hold anymore before alert fired
+	expect(15, 3*time.Minute, AlertInactive)
+	expect(5, 4*time.Minute, AlertPending)
+	expect(5, 6*time.Minute, AlertFiring)
+	expect(5, 7*time.Minute, AlertFiring)
+	// missing sample doesn't resolve alert
+	expect(math.NaN(), 7*time.Minute+30*time.Second, AlertFiring)
+	expect(15, 8*time.Minute, AlertResolved)
+	expect(15, 9*time.Minute, AlertResolved)
+
+	if len(AlertHistory) == 0 {
+		t.Fatal("resolved alert not in history")
+	}
+	ev := AlertHistory[len(AlertHistory)-1]
+	if ev.Name != "Low" || !ev.Start.Equal(start.Add(6*time.Minute)) ||
+		!ev.End.Equal(start.Add(8*time.Minute)) {
+		t.Fatalf("unexpected history entry %v", ev)
+	}
+}
+
+func TestAlertConfig(t *testing.T) {
+	if _, err := NewAlert("/test", AlertConfig{Name: "Bad", Property: "Free", Op: "=~"}); err == nil {
+		t.Fatal("accepted unknown operator")
+	}
+	if _, err := NewAlert("/test", AlertConfig{Name: "Bad", Property: "Free", Op: "<", For: "x"}); err == nil {
+		t.Fatal("accepted invalid duration")
+	}
+}
+
+func TestAlertPages(t *testing.T) {
+	// templates can't be parsed once pages were served, serve pages from separate template set
+	defer func(prev *template.Template) { masterTempl = prev }(masterTempl)
+	masterTempl = newMasterTemplate()
+	alerts, root := NewAlertHandler(), NewRootHandler()
+	firing, _ := NewAlert("/test/alertpage", AlertConfig{Name: "PageFiring", Property: "Free",
+		Op: "<", Threshold: 10})
+	resolved, _ := NewAlert("/test/alertpage", AlertConfig{Name: "PageResolved", Property: "Free",
+		Op: "<", Threshold: 10})
+	RegisterAlert(firing)
+	RegisterAlert(resolved)
+	defer UnregisterAlert(resolved)
+	now := time.Now()
+	firing.Evaluate(5, now)
+	resolved.Evaluate(5, now)
+	resolved.Evaluate(15, now.Add(time.Minute))
+
+	get := func(handler Handler, path string) string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 {
+			t.Fatalf("GET %s returned %d", path, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	if page := get(alerts, "/alerts"); !strings.Contains(page, "PageFiring") ||
+		!strings.Contains(page, "PageResolved") {
+		t.Fatalf("alerts missing on alert page:\n%s", page)
+	}
+
+	// state is encoded by name and active alerts have no end
+	var api map[string][]map[string]interface{}
+	if err := json.Unmarshal([]byte(get(alerts, "/alerts/api")), &api); err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, ev := range api["Active"] {
+		if ev["Name"] == "PageFiring" {
+			if _, ok := ev["End"]; ev["State"] != "firing" || ok {
+				t.Fatalf("unexpected active alert %v", ev)
+			}
+			found++
+		}
+	}
+	for _, ev := range api["Resolved"] {
+		if ev["Name"] == "PageResolved" {
+			if _, ok := ev["End"]; ev["State"] != "resolved" || !ok {
+				t.Fatalf("unexpected resolved alert %v", ev)
+			}
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("alerts missing in API response %v", api)
+	}
+
+	// root page shows number of firing alerts in red, or green banner if none
+	banner := fmt.Sprintf("%d alert(s) firing", FiringAlertCount())
+	if page := get(root, "/"); !strings.Contains(page, banner) ||
+		!strings.Contains(page, "background-color:red") {
+		t.Fatalf("missing banner %q on root page:\n%s", banner, page)
+	}
+	UnregisterAlert(firing)
+	if FiringAlertCount() == 0 {
+		if page := get(root, "/"); !strings.Contains(page, "No alerts firing") ||
+			!strings.Contains(page, "background-color:green") {
+			t.Fatalf("missing green banner on root page:\n%s", page)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (C) 2016, Heiko Koehler
+// commands run by handlers
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// commands running longer get killed by default
+	defaultCommandTimeout = time.Minute
+	// how long output of exited commands is read
+	cmdWaitDelay = time.Second
+	// waitid of single process
+	waitPID = 1
+)
+
+var ErrCommandTimeout = errors.New("Command timed out")
+
+// command with arguments, environment, working directory and input
+type Command struct {
+	Args []string
+	// environment variables as "KEY=value" added to environment of daemon
+	Env []string
+	// working directory, defaults to working directory of daemon
+	Dir string
+	// standard input, empty if none
+	Stdin string
+	// process group of command is killed after timeout, zero if none
+	Timeout time.Duration
+}
+
+// split command line into arguments separated by white space
+// single quotes preserve all characters, within double quotes backslash escapes " and \
+// outside of quotes backslash escapes any character
+func SplitCommandLine(s string) ([]string, error) {
+	var args = make([]string, 0)
+	var arg bytes.Buffer
+	// argument started, possibly by empty quotes
+	var inArg bool
+	// current quote character, zero outside of quotes
+	var quote rune
+	var escaped bool
+
+	for _, c := range s {
+		switch {
+		case escaped:
+			if quote == '"' && c != '"' && c != '\\' {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New(fmt.Sprintf("Unterminated quote or escape in command line %s", s))
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// create command from handler config
+// command is given either by command line "Cmd", which is run by /bin/sh in shell mode, or by
+// arguments "Args"
+func NewCommand(conf HandlerConfig) (*Command, error) {
+	var args []string
+	var timeout = defaultCommandTimeout
+	var err error
+
+	switch {
+	case conf.Cmd != "" && conf.Args != nil:
+		return nil, errors.New(fmt.Sprintf("Handler %s has both command line and arguments", conf.Name))
+	case conf.Shell && conf.Cmd == "":
+		return nil, errors.New(fmt.Sprintf("Handler %s in shell mode without command line", conf.Name))
+	case conf.Shell:
+		args = []string{"/bin/sh", "-c", conf.Cmd}
+	case conf.Args != nil:
+		args = conf.Args
+	default:
+		if args, err = SplitCommandLine(conf.Cmd); err != nil {
+			return nil, err
+		}
+	}
+	if len(args) == 0 {
+		return nil, errors.New(fmt.Sprintf("Handler %s without command", conf.Name))
+	}
+
+	if conf.Timeout != "" {
+		if timeout, err = ParseDuration(conf.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	env := make([]string, 0, len(conf.Env))
+	for key, val := range conf.Env {
+		env = append(env, key+"="+val)
+	}
+	sort.Strings(env)
+	return &Command{Args: args, Env: env, Dir: conf.Dir, Stdin: conf.Stdin, Timeout: timeout}, nil
+}
+
+// run command and return its standard output and error
+// command runs in its own process group, which is killed on timeout including processes
+// started by command, e.g. by shell
+// returns output up to timeout and ErrCommandTimeout on timeout
+func (cmd *Command) Run() ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	c := exec.Command(cmd.Args[0], cmd.Args[1:]...)
+	c.Dir = cmd.Dir
+	if len(cmd.Env) > 0 {
+		// later variables take precedence
+		c.Env = append(os.Environ(), cmd.Env...)
+	}
+	if cmd.Stdin != "" {
+		c.Stdin = strings.NewReader(cmd.Stdin)
+	}
+	c.Stdout, c.Stderr = &stdout, &stderr
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// processes which left process group might keep output open, stop waiting for them
+	c.WaitDelay = cmdWaitDelay
+	if err := c.Start(); err != nil {
+		return nil, nil, err
+	}
+	if cmd.Timeout > 0 {
+		var mutex sync.Mutex
+		var done, killed bool
+
+		pid := c.Process.Pid
+		timer := time.AfterFunc(cmd.Timeout, func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if !done {
+				syscall.Kill(-pid, syscall.SIGKILL)
+				killed = true
+			}
+		})
+		// process group ID can't be reused before command is reaped
+		waitExited(pid)
+		mutex.Lock()
+		done = true
+		mutex.Unlock()
+		timer.Stop()
+		err := c.Wait()
+		if killed {
+			err = ErrCommandTimeout
+		}
+		return stdout.Bytes(), stderr.Bytes(), err
+	}
+	err := c.Wait()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// block until process exited without reaping it
+func waitExited(pid int) {
+	// siginfo_t filled in by waitid
+	var info [128]byte
+
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, waitPID, uintptr(pid),
+			uintptr(unsafe.Pointer(&info[0])), syscall.WEXITED|syscall.WNOWAIT, 0, 0)
+		if errno != syscall.EINTR {
+			return
+		}
+	}
+}
+
+// exit code of command which ended with given error, -1 if command didn't exit normally
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// command line for display, arguments containing white space or quotes are quoted
+func (cmd *Command) String() string {
+	var args = make([]string, len(cmd.Args))
+
+	for i, arg := range cmd.Args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\") {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		args[i] = arg
+	}
+	return strings.Join(args, " ")
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2016, Heiko Koehler
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	var tests = []struct {
+		line string
+		args []string
+	}{
+		{"df -k", []string{"df", "-k"}},
+		{"  df \t -k  ", []string{"df", "-k"}},
+		{`df "/mnt/my disk"`, []string{"df", "/mnt/my disk"}},
+		{`echo 'a "b" \c'`, []string{"echo", `a "b" \c`}},
+		{`echo "a \"b\" \c"`, []string{"echo", `a "b" \c`}},
+		{`echo my\ disk ''`, []string{"echo", "my disk", ""}},
+		{`echo x"y z"`, []string{"echo", "xy z"}},
+	}
+	for _, test := range tests {
+		args, err := SplitCommandLine(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(args, "|") != strings.Join(test.args, "|") || len(args) != len(test.args) {
+			t.Fatalf("%s split into %q", test.line, args)
+		}
+	}
+	for _, line := range []string{`echo "a`, `echo 'a`, `echo a\`} {
+		if _, err := SplitCommandLine(line); err == nil {
+			t.Fatalf("accepted %s", line)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	var tests = []struct {
+		conf   HandlerConfig
+		stdout string
+		stderr string
+	}{
+		{HandlerConfig{Cmd: "echo 'a  b'"}, "a  b\n", ""},
+		{HandlerConfig{Args: []string{"echo", "a  b"}}, "a  b\n", ""},
+		{HandlerConfig{Cmd: "echo a b | tr a-z A-Z; echo err >&2", Shell: true}, "A B\n", "err\n"},
+		{HandlerConfig{Cmd: "echo $MAD_TEST", Shell: true, Env: map[string]string{"MAD_TEST": "x"}}, "x\n", ""},
+		{HandlerConfig{Cmd: "pwd", Dir: os.TempDir()}, os.TempDir() + "\n", ""},
+		{HandlerConfig{Cmd: "cat", Stdin: "input"}, "input", ""},
+	}
+	for _, test := range tests {
+		cmd, err := NewCommand(test.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout, stderr, err := cmd.Run()
+		if err != nil || string(stdout) != test.stdout || string(stderr) != test.stderr {
+			t.Fatalf("%s: unexpected output %q, %q, %v", cmd, stdout, stderr, err)
+		}
+	}
+
+	for _, conf := range []HandlerConfig{{}, {Cmd: "echo", Args: []string{"echo"}}, {Shell: true}} {
+		if _, err := NewCommand(conf); err == nil {
+			t.Fatalf("accepted command %+v", conf)
+		}
+	}
+	if cmd, _ := NewCommand(HandlerConfig{Args: []string{"df", "/mnt/my disk"}}); cmd.String() != "df '/mnt/my disk'" {
+		t.Fatalf("unexpected command line %s", cmd)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	// background process of shell keeps output open unless process group gets killed
+	cmd, err := NewCommand(HandlerConfig{Cmd: "echo started; sleep 10 & sleep 10", Shell: true,
+		Timeout: "100ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	stdout, _, err := cmd.Run()
+	if err != ErrCommandTimeout || string(stdout) != "started\n" {
+		t.Fatalf("unexpected output %q and error %v", stdout, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("command killed after %v", elapsed)
+	}
+
+	// process which left process group doesn't keep command running
+	if cmd, err = NewCommand(HandlerConfig{Cmd: "setsid sleep 10 & echo done", Shell: true,
+		Timeout: "100ms"}); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if stdout, _, _ = cmd.Run(); string(stdout) != "done\n" {
+		t.Fatalf("unexpected output %q", stdout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("waited %v for process outside of process group", elapsed)
+	}
+
+	if cmd, _ = NewCommand(HandlerConfig{Cmd: "true", Timeout: "0"}); cmd.Timeout != 0 {
+		t.Fatalf("unexpected timeout %v", cmd.Timeout)
+	}
+	if _, err := NewCommand(HandlerConfig{Cmd: "true", Timeout: "soon"}); err == nil {
+		t.Fatal("accepted invalid timeout")
+	}
+}
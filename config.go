@@ -4,19 +4,89 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
+	"time"
 )
 
 type Config struct {
-	Port     int // TCP port for HTTP service
-	Handlers []*HandlerConfig
+	Port int // TCP port for HTTP service
+	// directory storing time series, -data-dir flag takes precedence
+	// defaults to /var/lib/mad if run by root and ~/.local/share/mad otherwise
+	DataDir   string
+	Notifiers []NotifierConfig
+	// default time series levels of all handlers
+	Retention []RetentionConfig
+	Handlers  []*HandlerConfig
 }
 
+// time series level, e.g. {"Resolution": "1m", "Retention": "7d"}
+// levels are listed from finest to coarsest resolution
+type RetentionConfig struct {
+	// interval of rolled up data points, defaults to poll interval on first level
+	Resolution string
+	// how long data points are kept, e.g. "5h", "7d" or "52w"
+	Retention string
+	// aggregates kept on level, defaults to aggregates of handler, percentiles aren't supported
+	Aggregates []string
+}
+
+// notification channel for alerts
+type NotifierConfig struct {
+	Name string
+	Type string // one of webhook, exec, smtp
+	// webhook URL
+	URL string
+	// additional HTTP headers of webhook
+	Headers map[string]string
+	// command line run by exec notifier
+	Cmd string
+	// how long exec notifier may run before its process group gets killed, defaults to 30s
+	Timeout string
+	// address of SMTP relay, e.g. localhost:25
+	Addr     string
+	From     string
+	To       []string
+	User     string
+	Password string
+	// mail subject template
+	Subject string
+	// webhook or mail body template
+	Body string
+}
+
+// property extracted from command output or derived from other properties
+// built-in properties "_exit_code", "_duration_seconds" and "_output_bytes" of each command
+// handler with poll interval can be charted, derived from and alerted on like configured ones
 type PropertyConfig struct {
-	Name  string
+	Name string
+	// regex capturing value, or label and value of each matching line by two groups or groups
+	// named "label" and "value", e.g. "^(sd\\w+)\\s+([\\d.]+)"
+	// labeled properties store one time series per label
 	Regex string
+	// path of value in JSON output, e.g. "blockdevices.*.size", wildcards create labeled properties
+	Path string
+	// path of label relative to element matched by last wildcard, e.g. "name"
+	// labels are array indexes or object keys by default
+	Label string
+	// expression over properties defined before or by regex, e.g. "Used / (Used + Free) * 100"
+	// derived properties have no regex
+	Expr string
+	// one of gauge (default), counter or delta
+	// counters are stored as rate per second, deltas as increase since previous sample
+	Kind string
+	// one of bytes, seconds, percent, ratio (0..1 shown as percent), ops, bytes/s or ops/s
+	// values have no unit by default
+	Unit string
+	// multiplier converting samples into unit, e.g. 1024 for kilobytes
+	Scale float64
+	// time series levels of property, defaults to levels of handler
+	Retention []RetentionConfig
 }
 
 type ChartConfig struct {
@@ -24,6 +94,16 @@ type ChartConfig struct {
 	Properties []string
 }
 
+// threshold alert on property, e.g. fire if "Free" < 100000 for 2 minutes
+type AlertConfig struct {
+	Name      string
+	Property  string
+	Op        string // one of <, <=, >, >=, ==, !=
+	Threshold float64
+	For       string   // duration condition must hold before alert fires
+	Notify    []string // names of notifiers, all notifiers if empty
+}
+
 type HandlerConfig struct {
 	Type         string
 	Name         string
@@ -32,6 +112,41 @@ type HandlerConfig struct {
 	PollInterval string
 	Properties   []PropertyConfig
 	Charts       []ChartConfig
+	Alerts       []AlertConfig
+	// command line is split into arguments honoring quotes, or run by /bin/sh if Shell is set
+	// arguments may be given instead, e.g. ["df", "-k", "/mnt/my disk"]
+	Args  []string
+	Shell bool
+	// environment variables added to environment of daemon
+	Env map[string]string
+	// working directory of command
+	Dir string
+	// standard input of command
+	Stdin string
+	// how long command may run before its process group gets killed, defaults to 1m
+	// "0" disables timeout
+	Timeout string
+	// min interval between runs of command triggered by page views or run now, e.g. "10s"
+	// defaults to 1s, handlers with poll interval show result of last scheduled run
+	MinInterval string
+	// aggregates kept on rolled up levels, e.g. ["min", "max", "last"]
+	// one of min, max, sum, count or last besides mean, defaults to min and max
+	// percentiles like median or p95 aren't supported, since they can't be rolled up from
+	// aggregates of finer levels
+	Aggregates []string
+	// time series levels of all properties, defaults to global levels
+	Retention []RetentionConfig
+	// how much older than latest sample samples may be, e.g. "30s"
+	// later samples are rejected by default
+	LateWindow string
+	// format of command output, either text (default) parsed by regex or json
+	Format string
+	// max number of labels of each labeled property, defaults to 100
+	// further labels are dropped
+	MaxLabels int
+	// how long labels missing in output are kept before their time series get removed, e.g. "1h"
+	// defaults to retention of coarsest level
+	LabelExpiry string
 }
 
 func (conf HandlerConfig) String() string {
@@ -42,8 +157,119 @@ func (conf HandlerConfig) String() string {
 var (
 	ConfigPath string
 	Port       int
+	// global default time series levels
+	DefaultRetention []RetentionConfig
 )
 
+var durationDaysRegex = regexp.MustCompile(`^(\d+)([dw])(.*)$`)
+
+// parse duration like time.ParseDuration with additional units "d" and "w" for days and weeks
+// days and weeks have to come first, e.g. "1d12h"
+func ParseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+
+	if m := durationDaysRegex.FindStringSubmatch(s); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, err
+		}
+		d = time.Duration(n) * 24 * time.Hour
+		if m[2] == "w" {
+			d *= 7
+		}
+		if s = m[3]; s == "" {
+			return d, nil
+		}
+	}
+	if tmp, err := time.ParseDuration(s); err != nil {
+		return 0, err
+	} else {
+		return d + tmp, nil
+	}
+}
+
+// convert configured levels into time series levels
+// rolled up levels keep given aggregates unless configured otherwise
+func NewTimeSeriesProps(confs []RetentionConfig, pollInterval time.Duration,
+	aggs Aggregates) ([]TimeSeriesProps, error) {
+
+	var tsProps = make([]TimeSeriesProps, 0, len(confs))
+	var err error
+
+	for i, conf := range confs {
+		var prop = TimeSeriesProps{Aggregates: aggs}
+
+		if conf.Resolution != "" {
+			if prop.Resolution, err = ParseDuration(conf.Resolution); err != nil {
+				return nil, err
+			}
+		} else if i == 0 {
+			prop.Resolution = defaultLevels(pollInterval)[0].Resolution
+		} else {
+			return nil, errors.New(fmt.Sprintf("Missing resolution on level %d", i))
+		}
+		if prop.Retention, err = ParseDuration(conf.Retention); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			// top level stores samples which aren't rolled up
+			prop.Aggregates = 0
+		}
+		if conf.Aggregates != nil {
+			if prop.Aggregates, err = ParseAggregates(conf.Aggregates); err != nil {
+				return nil, err
+			}
+		}
+		tsProps = append(tsProps, prop)
+	}
+	if err := ValidateTimeSeriesProps(tsProps); err != nil {
+		return nil, err
+	}
+	return tsProps, nil
+}
+
+// time series levels of handlers without own levels
+// global default levels are adapted to poll interval like default levels, i.e. top level stores
+// samples at poll interval if coarser and rolled up levels which aren't coarser are dropped
+func DefaultTimeSeriesProps(pollInterval time.Duration, aggs Aggregates) ([]TimeSeriesProps, error) {
+	if DefaultRetention == nil {
+		tsProps := defaultLevels(pollInterval)
+		// top level stores samples which aren't rolled up
+		for i := 1; i < len(tsProps); i++ {
+			tsProps[i].Aggregates = aggs
+		}
+		return tsProps, nil
+	}
+	tsProps, err := NewTimeSeriesProps(DefaultRetention, 0, aggs)
+	if err != nil {
+		return nil, err
+	}
+	top := tsProps[0]
+	if pollInterval > top.Resolution {
+		top.Resolution = pollInterval
+		if top.Retention < pollInterval {
+			top.Retention = pollInterval
+		}
+	}
+	adapted := []TimeSeriesProps{top}
+	for _, prop := range tsProps[1:] {
+		if prop.Resolution > top.Resolution {
+			adapted = append(adapted, prop)
+		}
+	}
+	return adapted, nil
+}
+
+// whether data directory was given on command line
+func dataDirFlagSet() (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "data-dir" {
+			set = true
+		}
+	})
+	return
+}
+
 // create HTTP handlers from config
 func LoadConfig(f *os.File) {
 	var config Config
@@ -57,6 +283,27 @@ func LoadConfig(f *os.File) {
 		Port = config.Port
 		log.Printf("Port: %d\n", Port)
 	}
+	if config.DataDir != "" && !dataDirFlagSet() {
+		DataDir = config.DataDir
+	}
+	if err := OpenDataDir(DataDir); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Data directory: %s\n", DataDir)
+	if config.Retention != nil {
+		// validate levels once instead of for each handler
+		if _, err := NewTimeSeriesProps(config.Retention, 0, 0); err != nil {
+			log.Fatal(err)
+		}
+		DefaultRetention = config.Retention
+	}
+	for _, notifierConf := range config.Notifiers {
+		if notifier, err := NewNotifier(notifierConf); err == nil {
+			RegisterNotifier(notifier)
+		} else {
+			log.Fatal(err)
+		}
+	}
 	for _, handlerConf := range config.Handlers {
 		log.Println(handlerConf)
 		if handler, err := NewHandler(*handlerConf); err == nil {
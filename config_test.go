@@ -0,0 +1,143 @@
+// Copyright (C) 2016, Heiko Koehler
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	var tests = []struct {
+		s string
+		d time.Duration
+	}{
+		{"90s", 90 * time.Second},
+		{"7d", 7 * 24 * time.Hour},
+		{"1d12h", 36 * time.Hour},
+		{"52w", 52 * 7 * 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		if d, err := ParseDuration(test.s); err != nil {
+			t.Fatal(err)
+		} else if d != test.d {
+			t.Fatalf("parsed %s as %v", test.s, d)
+		}
+	}
+	for _, s := range []string{"", "d", "7x", "1d12"} {
+		if _, err := ParseDuration(s); err == nil {
+			t.Fatalf("accepted invalid duration %s", s)
+		}
+	}
+}
+
+func TestRetentionConfig(t *testing.T) {
+	confs := []RetentionConfig{
+		{Retention: "1h"},
+		{Resolution: "1m", Retention: "1d", Aggregates: []string{"max"}},
+		{Resolution: "1h", Retention: "52w"},
+	}
+	tsProps, err := NewTimeSeriesProps(confs, 10*time.Second, AggMin|AggMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tsProps) != 3 || tsProps[0].Resolution != 10*time.Second || tsProps[0].Aggregates != 0 ||
+		tsProps[1].Aggregates != AggMax || tsProps[2].Aggregates != AggMin|AggMax ||
+		tsProps[2].Retention != 52*7*24*time.Hour {
+		t.Fatalf("unexpected levels %+v", tsProps)
+	}
+
+	var invalid = [][]RetentionConfig{
+		// missing resolution of rolled up level
+		{{Retention: "1h"}, {Retention: "1d"}},
+		// resolution not getting coarser
+		{{Retention: "1h"}, {Resolution: "1h", Retention: "1d"}, {Resolution: "1m", Retention: "7d"}},
+		// retention shorter than resolution
+		{{Retention: "1h"}, {Resolution: "1h", Retention: "1m"}},
+		{{Retention: "forever"}},
+		{},
+	}
+	for _, confs := range invalid {
+		if _, err := NewTimeSeriesProps(confs, time.Second, 0); err == nil {
+			t.Fatalf("accepted invalid levels %+v", confs)
+		}
+	}
+}
+
+func TestDefaultRetention(t *testing.T) {
+	defer func(prev []RetentionConfig) { DefaultRetention = prev }(DefaultRetention)
+	DefaultRetention = []RetentionConfig{
+		{Retention: "5m"},
+		{Resolution: "1m", Retention: "5h"},
+		{Resolution: "1h", Retention: "10d"},
+	}
+	var tests = []struct {
+		pollInterval time.Duration
+		resolutions  []time.Duration
+	}{
+		{0, []time.Duration{time.Second, time.Minute, time.Hour}},
+		{10 * time.Second, []time.Duration{10 * time.Second, time.Minute, time.Hour}},
+		// levels which aren't coarser than poll interval are dropped
+		{time.Minute, []time.Duration{time.Minute, time.Hour}},
+		{2 * time.Hour, []time.Duration{2 * time.Hour}},
+	}
+	for _, test := range tests {
+		tsProps, err := DefaultTimeSeriesProps(test.pollInterval, AggMax)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tsProps) != len(test.resolutions) || tsProps[0].Aggregates != 0 ||
+			tsProps[len(tsProps)-1].Aggregates != AggMax && len(tsProps) > 1 {
+			t.Fatalf("unexpected levels for poll interval %v: %+v", test.pollInterval, tsProps)
+		}
+		for i, res := range test.resolutions {
+			if tsProps[i].Resolution != res {
+				t.Fatalf("unexpected levels for poll interval %v: %+v", test.pollInterval, tsProps)
+			}
+		}
+		if err := ValidateTimeSeriesProps(tsProps); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// all handlers of sample config can be created
+func TestSampleConfig(t *testing.T) {
+	var config Config
+
+	dir, err := ioutil.TempDir("", "TestSampleConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(prev string) { DataDir = prev }(DataDir)
+	defer func(prev []RetentionConfig) { DefaultRetention = prev }(DefaultRetention)
+	DataDir = dir
+
+	f, err := os.Open("sample_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTimeSeriesProps(config.Retention, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	DefaultRetention = config.Retention
+	for _, notifierConf := range config.Notifiers {
+		if _, err := NewNotifier(notifierConf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, handlerConf := range config.Handlers {
+		if _, err := NewHandler(*handlerConf); err != nil {
+			t.Fatalf("%s: %v", handlerConf.Name, err)
+		}
+	}
+}
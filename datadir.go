@@ -0,0 +1,145 @@
+// Copyright (C) 2016, Heiko Koehler
+// data directory holding time series of all handlers
+//
+// The directory is locked while in use, so that two daemons never write the same time series.
+// A version marker records the layout of the directory, so that future changes of the storage
+// format can be detected and migrated on startup.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	dataDirLockFile    = "LOCK"
+	dataDirVersionFile = "VERSION"
+	// current layout of data directory
+	dataDirVersion = 1
+)
+
+var (
+	// directory storing time series
+	DataDir = defaultDataDir()
+	// open lock file of data directory
+	dataDirLock *os.File
+	// default data directory of earlier versions, which didn't survive reboots
+	legacyDataDir = filepath.Join(os.TempDir(), "mad")
+)
+
+// persistent default data directory, /var/lib/mad if run by root and data directory of user
+// otherwise, e.g. ~/.local/share/mad
+func defaultDataDir() string {
+	if os.Geteuid() == 0 {
+		return "/var/lib/mad"
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "mad")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "share", "mad")
+	}
+	return "/var/lib/mad"
+}
+
+// move time series of legacy default data directory into new default data directory
+// legacy data is left in place if new directory is in use, or legacy directory is locked or
+// on another file system
+func migrateDataDir(dir, legacy string) {
+	if _, err := os.Stat(filepath.Join(dir, dataDirVersionFile)); !os.IsNotExist(err) {
+		return
+	}
+	if fi, err := os.Stat(legacy); err != nil || !fi.IsDir() {
+		return
+	}
+	lock, err := os.OpenFile(filepath.Join(legacy, dataDirLockFile), os.O_CREATE|os.O_RDWR, 0660)
+	if err == nil {
+		defer lock.Close()
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	}
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(dir), 0770); err == nil {
+			// succeeds if new directory is missing or empty
+			err = os.Rename(legacy, dir)
+		}
+	}
+	if err != nil {
+		log.Printf("Time series of earlier versions left in %s: %v\n", legacy, err)
+		log.Printf("Stop daemon and move %s to %s to keep them\n", legacy, dir)
+		return
+	}
+	log.Printf("Moved data directory %s to %s\n", legacy, dir)
+}
+
+// create and lock data directory and check its version
+// directories without version marker are assumed to be of current version
+// default data directory takes over data directory of earlier versions
+func OpenDataDir(dir string) error {
+	if dir == defaultDataDir() {
+		migrateDataDir(dir, legacyDataDir)
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, dataDirLockFile), os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return errors.New(fmt.Sprintf("Data directory %s in use by another process: %v", dir, err))
+	}
+	// record owner for diagnostics
+	lock.Truncate(0)
+	lock.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+
+	if err := checkDataDirVersion(dir); err != nil {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+		return err
+	}
+	dataDirLock, DataDir = lock, dir
+	return nil
+}
+
+// read version marker of data directory and write it if missing
+func checkDataDirVersion(dir string) error {
+	var version int
+
+	path := filepath.Join(dir, dataDirVersionFile)
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return writeFileAtomic(path, []byte(fmt.Sprintf("%d\n", dataDirVersion)), true)
+	} else if err != nil {
+		return err
+	}
+	if n, _ := fmt.Sscanf(strings.TrimSpace(string(buf)), "%d", &version); n != 1 {
+		return errors.New(fmt.Sprintf("Corrupt version marker %s", path))
+	}
+	// migrations of older layouts go here
+	if version != dataDirVersion {
+		return errors.New(fmt.Sprintf("Data directory %s has unsupported version %d (expected %d)",
+			dir, version, dataDirVersion))
+	}
+	return nil
+}
+
+// unlock data directory
+func CloseDataDir() {
+	if dataDirLock != nil {
+		syscall.Flock(int(dataDirLock.Fd()), syscall.LOCK_UN)
+		dataDirLock.Close()
+		dataDirLock = nil
+	}
+}
+
+// directory of time series of handler property
+func timeSeriesPath(url, prop string) string {
+	return filepath.Join(DataDir, url, prop)
+}
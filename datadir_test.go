@@ -0,0 +1,84 @@
+// Copyright (C) 2016, Heiko Koehler
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDataDir(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "TestDataDir")
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	defer func(prev string) { DataDir = prev }(DataDir)
+
+	// time series survive reboots by default
+	if def := defaultDataDir(); !filepath.IsAbs(def) || strings.HasPrefix(def, os.TempDir()) {
+		t.Fatalf("unexpected default data directory %s", def)
+	}
+
+	if err := OpenDataDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if timeSeriesPath("/cpu", "user") != filepath.Join(dir, "cpu", "user") {
+		t.Fatalf("time series outside data directory: %s", timeSeriesPath("/cpu", "user"))
+	}
+	// second daemon must not use locked directory
+	if err := OpenDataDir(dir); err == nil {
+		t.Fatal("locked data directory twice")
+	}
+	CloseDataDir()
+	if err := OpenDataDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	CloseDataDir()
+
+	// directory written by future version is rejected
+	ioutil.WriteFile(filepath.Join(dir, dataDirVersionFile), []byte("2\n"), 0660)
+	if err := OpenDataDir(dir); err == nil {
+		t.Fatal("accepted data directory of unsupported version")
+	}
+}
+
+func TestMigrateDataDir(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "TestMigrateDataDir")
+	os.RemoveAll(base)
+	defer os.RemoveAll(base)
+	legacy, dir := filepath.Join(base, "tmp", "mad"), filepath.Join(base, "share", "mad")
+	os.MkdirAll(filepath.Join(legacy, "cpu", "user"), 0770)
+
+	// legacy data stays in place while locked by running daemon
+	defer func(prev string) { DataDir = prev }(DataDir)
+	if err := OpenDataDir(legacy); err != nil {
+		t.Fatal(err)
+	}
+	migrateDataDir(dir, legacy)
+	CloseDataDir()
+	if _, err := os.Stat(filepath.Join(legacy, "cpu", "user")); err != nil {
+		t.Fatal("moved locked data directory")
+	}
+	os.Remove(filepath.Join(legacy, dataDirVersionFile))
+
+	migrateDataDir(dir, legacy)
+	if _, err := os.Stat(filepath.Join(dir, "cpu", "user")); err != nil {
+		t.Fatalf("time series not moved: %v", err)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatal("legacy data directory left behind")
+	}
+
+	// directory of current version is kept
+	os.MkdirAll(filepath.Join(legacy, "disk"), 0770)
+	if err := OpenDataDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	CloseDataDir()
+	migrateDataDir(dir, legacy)
+	if _, err := os.Stat(filepath.Join(dir, "disk")); !os.IsNotExist(err) {
+		t.Fatal("legacy data moved into data directory of current version")
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (C) 2016, Heiko Koehler
+// arithmetic expressions over properties of handler, e.g. "Used / (Used + Free) * 100"
+//
+// Grammar:
+//
+//	expr    = term {("+" | "-") term}
+//	term    = unary {("*" | "/") unary}
+//	unary   = "-" unary | primary
+//	primary = number | name | func "(" expr {"," expr} ")" | "(" expr ")"
+//	func    = "min" | "max"
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// node of expression tree
+type exprNode interface {
+	eval(vars map[string]float64) float64
+}
+
+type exprNumber float64
+
+type exprVar string
+
+type exprUnary struct {
+	operand exprNode
+}
+
+type exprBinary struct {
+	op          byte
+	left, right exprNode
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+func (n exprNumber) eval(vars map[string]float64) float64 {
+	return float64(n)
+}
+
+// unknown variables evaluate to NaN
+func (n exprVar) eval(vars map[string]float64) float64 {
+	if val, ok := vars[string(n)]; ok {
+		return val
+	}
+	return math.NaN()
+}
+
+func (n exprUnary) eval(vars map[string]float64) float64 {
+	return -n.operand.eval(vars)
+}
+
+// division by zero evaluates to NaN
+func (n exprBinary) eval(vars map[string]float64) float64 {
+	left, right := n.left.eval(vars), n.right.eval(vars)
+	switch n.op {
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	case '*':
+		return left * right
+	}
+	if right == 0 {
+		return math.NaN()
+	}
+	return left / right
+}
+
+// NaN arguments make result NaN
+func (n exprCall) eval(vars map[string]float64) float64 {
+	result := n.args[0].eval(vars)
+	for _, arg := range n.args[1:] {
+		val := arg.eval(vars)
+		if math.IsNaN(val) || math.IsNaN(result) {
+			return math.NaN()
+		}
+		if n.name == "min" {
+			result = math.Min(result, val)
+		} else {
+			result = math.Max(result, val)
+		}
+	}
+	return result
+}
+
+// parsed expression
+type Expr struct {
+	src  string
+	root exprNode
+	// names of referenced variables in order of first occurrence
+	vars []string
+}
+
+// recursive descent parser of expressions
+type exprParser struct {
+	src  string
+	pos  int
+	vars []string
+}
+
+// parse expression
+func ParseExpr(src string) (*Expr, error) {
+	p := &exprParser{src: src}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	return &Expr{src: src, root: root, vars: p.vars}, nil
+}
+
+// names of variables referenced by expression
+func (expr *Expr) Vars() []string {
+	return expr.vars
+}
+
+// evaluate expression, result is NaN if any referenced variable is unknown or NaN
+func (expr *Expr) Eval(vars map[string]float64) float64 {
+	return expr.root.eval(vars)
+}
+
+// Stringer interface
+func (expr *Expr) String() string {
+	return expr.src
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("Invalid expression \"%s\" at %d: %s", p.src, p.pos,
+		fmt.Sprintf(format, args...)))
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// consume given character if next
+func (p *exprParser) accept(c byte) bool {
+	if p.skipSpace(); p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+
+		if p.accept('+') {
+			op = '+'
+		} else if p.accept('-') {
+			op = '-'
+		} else {
+			return left, nil
+		}
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op, left, right}
+	}
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+
+		if p.accept('*') {
+			op = '*'
+		} else if p.accept('/') {
+			op = '/'
+		} else {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op, left, right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept('-') {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || unicode.IsLetter(rune(c)) || (!first && (c == '.' || unicode.IsDigit(rune(c))))
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.accept('(') {
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, p.errorf("missing )")
+		}
+		return node, nil
+	}
+	p.skipSpace()
+	start := p.pos
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("unexpected end")
+	}
+	if c := p.src[p.pos]; c == '.' || unicode.IsDigit(rune(c)) {
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+		val, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", p.src[start:p.pos])
+		}
+		return exprNumber(val), nil
+	}
+	for p.pos < len(p.src) && isNameChar(p.src[p.pos], p.pos == start) {
+		p.pos++
+	}
+	if p.pos == start {
+		return nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	name := p.src[start:p.pos]
+	if !p.accept('(') {
+		for _, v := range p.vars {
+			if v == name {
+				return exprVar(name), nil
+			}
+		}
+		p.vars = append(p.vars, name)
+		return exprVar(name), nil
+	}
+	if fn := strings.ToLower(name); fn == "min" || fn == "max" {
+		var args []exprNode
+
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.accept(')') {
+				return exprCall{fn, args}, nil
+			}
+			if !p.accept(',') {
+				return nil, p.errorf("missing , or )")
+			}
+		}
+	}
+	return nil, p.errorf("unknown function %s", name)
+}
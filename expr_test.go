@@ -0,0 +1,47 @@
+// Copyright (C) 2016, Heiko Koehler
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	var vars = map[string]float64{"Used": 30, "Free": 10, "rx_bytes": 5, "eth0.tx": 7, "Zero": 0}
+	var tests = []struct {
+		src string
+		val float64
+	}{
+		{"Used / (Used + Free) * 100", 75},
+		{"1 + 2 * 3 - 4 / 2", 5},
+		{"-Used + -(-Free)", -20},
+		{"2 * -3", -6},
+		{"min(Used, Free, 20) + max(rx_bytes, eth0.tx)", 17},
+		{"MAX(1.5, .5)", 1.5},
+		{"(((Free)))", 10},
+		{"Used / Zero", math.NaN()},
+		{"Unknown + 1", math.NaN()},
+		{"min(Unknown, 1)", math.NaN()},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseExpr(test.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val := expr.Eval(vars); val != test.val && !(math.IsNaN(val) && math.IsNaN(test.val)) {
+			t.Fatalf("%s evaluated to %f instead of %f", test.src, val, test.val)
+		}
+	}
+	if expr, _ := ParseExpr("Used / (Used + Free) + Used"); len(expr.Vars()) != 2 ||
+		expr.Vars()[0] != "Used" || expr.Vars()[1] != "Free" {
+		t.Fatalf("unexpected variables %v", expr.Vars())
+	}
+
+	for _, src := range []string{"", "1 +", "(1 + 2", "1 2", "sqrt(4)", "min()", "max(1,", "1 $ 2", "1..2"} {
+		if _, err := ParseExpr(src); err == nil {
+			t.Fatalf("accepted invalid expression %q", src)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright (C) 2016, Heiko Koehler
+// compression of data points as described in "Gorilla: A Fast, Scalable,
+// In-Memory Time Series Database" (Pelkonen et al., VLDB 2015)
+//
+// Time stamps are stored as delta of deltas in nanoseconds with variable length
+// encoding, values are XORed with previous value and only meaningful bits are stored.
+package main
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"time"
+)
+
+var errShortBuffer = errors.New("Compressed data truncated")
+
+// append-only bit stream
+type bitWriter struct {
+	buf []byte
+	// number of bits used in last byte of buf
+	used uint
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.used == 0 || w.used == 8 {
+		w.buf = append(w.buf, 0)
+		w.used = 0
+	}
+	if bit {
+		w.buf[len(w.buf)-1] |= 0x80 >> w.used
+	}
+	w.used++
+}
+
+// write lowest n bits of val, most significant bit first
+func (w *bitWriter) writeBits(val uint64, n uint) {
+	for i := n; i > 0; i-- {
+		w.writeBit(val&(1<<(i-1)) != 0)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	// position of next bit
+	pos uint
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= uint(len(r.buf))*8 {
+		return false, errShortBuffer
+	}
+	bit := r.buf[r.pos/8]&(0x80>>(r.pos%8)) != 0
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	var val uint64
+
+	for i := uint(0); i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		val <<= 1
+		if bit {
+			val |= 1
+		}
+	}
+	return val, nil
+}
+
+// widths of signed delta of deltas in bits
+// width is selected by unary prefix, i.e. number of 1 bits followed by 0 bit,
+// the prefix of the last width has no terminating 0 bit
+var dodWidths = []uint{0, 12, 20, 32, 64}
+
+// encoder of time stamps
+type tstampEncoder struct {
+	prev, prevDelta int64
+	started         bool
+}
+
+func (enc *tstampEncoder) encode(w *bitWriter, t time.Time) {
+	ns := t.UnixNano()
+	if !enc.started {
+		w.writeBits(uint64(ns), 64)
+		enc.prev, enc.started = ns, true
+		return
+	}
+	delta := ns - enc.prev
+	dod := delta - enc.prevDelta
+	enc.prev, enc.prevDelta = ns, delta
+	if dod == 0 {
+		w.writeBit(false)
+		return
+	}
+	last := len(dodWidths) - 1
+	for i := 1; i <= last; i++ {
+		width := dodWidths[i]
+		if i == last || (dod >= -(1<<(width-1)) && dod < 1<<(width-1)) {
+			w.writeBits(1<<uint(i)-1, uint(i))
+			if i < last {
+				w.writeBit(false)
+			}
+			w.writeBits(uint64(dod), width)
+			return
+		}
+	}
+}
+
+type tstampDecoder struct {
+	prev, prevDelta int64
+	started         bool
+}
+
+func (dec *tstampDecoder) decode(r *bitReader) (time.Time, error) {
+	var dod int64
+	var i int
+
+	if !dec.started {
+		ns, err := r.readBits(64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		dec.prev, dec.started = int64(ns), true
+		return time.Unix(0, dec.prev), nil
+	}
+	for i < len(dodWidths)-1 {
+		bit, err := r.readBit()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !bit {
+			break
+		}
+		i++
+	}
+	if width := dodWidths[i]; width > 0 {
+		val, err := r.readBits(width)
+		if err != nil {
+			return time.Time{}, err
+		}
+		// sign extend
+		shift := 64 - width
+		dod = int64(val<<shift) >> shift
+	}
+	dec.prevDelta += dod
+	dec.prev += dec.prevDelta
+	return time.Unix(0, dec.prev), nil
+}
+
+// encoder of float values
+type valueEncoder struct {
+	prev              uint64
+	leading, trailing uint
+	started           bool
+	// whether leading and trailing define window of meaningful bits
+	window bool
+}
+
+func (enc *valueEncoder) encode(w *bitWriter, v float64) {
+	val := math.Float64bits(v)
+	if !enc.started {
+		w.writeBits(val, 64)
+		enc.prev, enc.started = val, true
+		return
+	}
+	xor := val ^ enc.prev
+	enc.prev = val
+	if xor == 0 {
+		w.writeBit(false)
+		return
+	}
+	w.writeBit(true)
+	leading := uint(bits.LeadingZeros64(xor))
+	trailing := uint(bits.TrailingZeros64(xor))
+	// 5 bits for number of leading zeros
+	if leading > 31 {
+		leading = 31
+	}
+	if enc.window && leading >= enc.leading && trailing >= enc.trailing {
+		// meaningful bits fit into previous window
+		w.writeBit(false)
+		w.writeBits(xor>>enc.trailing, 64-enc.leading-enc.trailing)
+		return
+	}
+	enc.leading, enc.trailing, enc.window = leading, trailing, true
+	meaningful := 64 - leading - trailing
+	w.writeBit(true)
+	w.writeBits(uint64(leading), 5)
+	// 64 meaningful bits are encoded as 0
+	w.writeBits(uint64(meaningful&63), 6)
+	w.writeBits(xor>>trailing, meaningful)
+}
+
+type valueDecoder struct {
+	prev              uint64
+	leading, trailing uint
+	started           bool
+}
+
+func (dec *valueDecoder) decode(r *bitReader) (float64, error) {
+	if !dec.started {
+		val, err := r.readBits(64)
+		if err != nil {
+			return 0, err
+		}
+		dec.prev, dec.started = val, true
+		return math.Float64frombits(val), nil
+	}
+	if bit, err := r.readBit(); err != nil {
+		return 0, err
+	} else if !bit {
+		return math.Float64frombits(dec.prev), nil
+	}
+	newWindow, err := r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if newWindow {
+		leading, err := r.readBits(5)
+		if err != nil {
+			return 0, err
+		}
+		meaningful, err := r.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		if meaningful == 0 {
+			meaningful = 64
+		}
+		dec.leading = uint(leading)
+		dec.trailing = 64 - dec.leading - uint(meaningful)
+	}
+	xor, err := r.readBits(64 - dec.leading - dec.trailing)
+	if err != nil {
+		return 0, err
+	}
+	dec.prev ^= xor << dec.trailing
+	return math.Float64frombits(dec.prev), nil
+}
+
+// compress data points including given aggregates into bit stream
+// values and aggregates are XORed with previous value of same column
+func compressDataPoints(data []DataPoint, aggs Aggregates) []byte {
+	var w bitWriter
+	var tenc tstampEncoder
+	var venc valueEncoder
+	var aenc = make([]valueEncoder, aggs.Len())
+
+	for _, dp := range data {
+		tenc.encode(&w, dp.Tstamp)
+		venc.encode(&w, dp.Val)
+		for i, col := range aggs.columns(dp) {
+			aenc[i].encode(&w, col)
+		}
+	}
+	return w.buf
+}
+
+// decompress given number of data points from bit stream
+func decompressDataPoints(buf []byte, count int, aggs Aggregates) ([]DataPoint, error) {
+	var data = make([]DataPoint, 0, count)
+	var r = bitReader{buf: buf}
+	var tdec tstampDecoder
+	var vdec valueDecoder
+	var adec = make([]valueDecoder, aggs.Len())
+	var cols = make([]float64, aggs.Len())
+	var err error
+
+	for i := 0; i < count; i++ {
+		var dp DataPoint
+
+		if dp.Tstamp, err = tdec.decode(&r); err != nil {
+			return nil, err
+		}
+		if dp.Val, err = vdec.decode(&r); err != nil {
+			return nil, err
+		}
+		for j := range adec {
+			if cols[j], err = adec[j].decode(&r); err != nil {
+				return nil, err
+			}
+		}
+		aggs.setColumns(&dp, cols)
+		data = append(data, dp)
+	}
+	return data, nil
+}
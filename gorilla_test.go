@@ -0,0 +1,89 @@
+// Copyright (C) 2016, Heiko Koehler
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func checkCompression(t *testing.T, data []DataPoint, aggs Aggregates) []byte {
+	buf := compressDataPoints(data, aggs)
+	res, err := decompressDataPoints(buf, len(data), aggs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range data {
+		if !res[i].Tstamp.Equal(data[i].Tstamp) ||
+			math.Float64bits(res[i].Val) != math.Float64bits(data[i].Val) {
+			t.Fatalf("data point %d: expected %v got %v", i, data[i], res[i])
+		}
+		for j, col := range aggs.columns(data[i]) {
+			if math.Float64bits(aggs.columns(res[i])[j]) != math.Float64bits(col) {
+				t.Fatalf("aggregates of data point %d: expected %v got %v", i, data[i], res[i])
+			}
+		}
+	}
+	return buf
+}
+
+func TestCompression(t *testing.T) {
+	var regular, jitter, random, rolledUp []DataPoint
+
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		regular = append(regular, NewDataPoint(start.Add(time.Duration(i)*time.Second), float64(i%10)))
+		jitter = append(jitter, NewDataPoint(start.Add(time.Duration(i)*time.Second+
+			time.Duration(rand.Int63n(int64(time.Millisecond)))), rand.Float64()))
+		random = append(random, DataPoint{Tstamp: time.Unix(0, rand.Int63()), Val: rand.NormFloat64() * 1e9})
+		val := rand.Float64()
+		rolledUp = append(rolledUp, DataPoint{Tstamp: start.Add(time.Duration(i) * time.Minute),
+			Val: val, Min: val - rand.Float64(), Max: val + rand.Float64(), Sum: 60 * val,
+			Count: 60, Last: rand.Float64()})
+	}
+	special := []DataPoint{NewDataPoint(start, math.NaN()), NewDataPoint(start, math.Inf(1)),
+		NewDataPoint(start.Add(-time.Hour), 0), NewDataPoint(start, -1),
+		NewDataPoint(start.Add(time.Hour), math.MaxFloat64),
+		NewDataPoint(start, math.SmallestNonzeroFloat64)}
+
+	if buf := checkCompression(t, regular, 0); len(buf) > len(regular)*logRecordSize/5 {
+		t.Fatalf("regular time series compressed to %d bytes", len(buf))
+	}
+	checkCompression(t, jitter, 0)
+	checkCompression(t, random, 0)
+	checkCompression(t, special, AggMin|AggLast)
+	checkCompression(t, rolledUp, AggMin|AggMax|AggSum|AggCount|AggLast)
+	checkCompression(t, rolledUp, AggMax|AggCount)
+	checkCompression(t, nil, 0)
+}
+
+func TestSealedLogs(t *testing.T) {
+	tsPath := filepath.Join(os.TempDir(), "TestSealedLogs")
+	os.RemoveAll(tsPath)
+	defer os.RemoveAll(tsPath)
+
+	ts, err := NewTimeSeries(tsPath, time.Second, 100*time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addSeries(t, ts, testStart, 0, 175)
+	for _, log := range ts.Logs[:len(ts.Logs)-1] {
+		if !log.sealed {
+			t.Fatalf("log %s not sealed", log.path)
+		}
+	}
+	validateTimeSeries(t, ts, 100, 1)
+	ts.Close()
+
+	// reopen time series and keep adding data points
+	if ts, err = NewTimeSeries(tsPath, time.Second, 100*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	addSeries(t, ts, testStart, 175, 300)
+	validateTimeSeries(t, ts, 100, 1)
+}
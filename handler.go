@@ -3,18 +3,24 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -61,50 +67,593 @@ func RegisterHandler(entry Handler) {
 	http.Handle(entry.Path()+"/", entry)
 }
 
-// Property definition w/ regex
+// default time series levels, i.e. samples of last 5 minutes, minutes of last 5 hours
+// and hours of last 10 days
+// rolled up levels keep min and max of data points
+var defaultTimeSeriesProps = []TimeSeriesProps{
+	{time.Second, 5 * time.Minute, 0},
+	{time.Minute, 5 * time.Hour, AggMin | AggMax},
+	{time.Hour, 10 * 24 * time.Hour, AggMin | AggMax}}
+
+// default time series levels for given poll interval
+// top level stores samples at poll interval, rolled up levels which aren't coarser are dropped
+func defaultLevels(pollInterval time.Duration) []TimeSeriesProps {
+	top := defaultTimeSeriesProps[0]
+	if pollInterval > 0 {
+		top.Resolution = pollInterval
+		if top.Retention < pollInterval {
+			top.Retention = pollInterval
+		}
+	}
+	tsProps := []TimeSeriesProps{top}
+	for _, prop := range defaultTimeSeriesProps[1:] {
+		if prop.Resolution > top.Resolution {
+			tsProps = append(tsProps, prop)
+		}
+	}
+	return tsProps
+}
+
+// kinds of properties
+const (
+	// value is stored as is
+	KindGauge = "gauge"
+	// monotonically increasing counter, rate per second is stored
+	KindCounter = "counter"
+	// monotonically increasing counter, increase since previous sample is stored
+	KindDelta = "delta"
+)
+
+// Property definition w/ regex or expression over other properties
+// labeled properties capture label and value of each matching line and keep one time series
+// per label, their TS is nil
 type Property struct {
 	Regex *regexp.Regexp
+	Expr  *Expr
 	TS    *TimeSeriesTable
+	Kind  string
+	// unit of stored values, i.e. rate per second for counters
+	Unit Unit
+	// multiplier converting samples into unit
+	Scale float64
+	// time series levels from finest to coarsest
+	Levels []TimeSeriesProps
+	// path of value and label in JSON output
+	Path      JSONPath
+	LabelPath JSONPath
+	// submatch indexes of label and value, label is zero if property isn't labeled
+	labelGroup int
+	valueGroup int
+	labeled    bool
+	// previous sample of counters and its time stamp, zero if unknown
+	prev     float64
+	prevTime time.Time
+	// path of property time series, late window of top levels and alerts on labels
+	path       string
+	lateWindow time.Duration
+	alerts     []AlertConfig
+	// map label to property storing its values, guarded by mutex
+	mutex  sync.Mutex
+	labels map[string]*Property
+	// label was found in previous output and when it was last found
+	present  bool
+	lastSeen time.Time
+	// max number of labels and how long missing labels are kept
+	maxLabels   int
+	labelExpiry time.Duration
+	// max number of labels was reached
+	capped bool
+}
+
+// labels of properties are capped by default
+const defaultMaxLabels = 100
+
+var errTooManyLabels = errors.New("Too many labels")
+
+// submatch indexes of label and value captured by regex
+// regex captures either value only or label and value, by position or by named groups
+// "label" and "value"
+func regexGroups(re *regexp.Regexp) (label, value int, ok bool) {
+	for i, name := range re.SubexpNames() {
+		switch name {
+		case "label":
+			label = i
+		case "value":
+			value = i
+		}
+	}
+	if value > 0 {
+		return label, value, true
+	}
+	switch re.NumSubexp() {
+	case 1:
+		return 0, 1, true
+	case 2:
+		return 1, 2, true
+	}
+	return 0, 0, false
+}
+
+// property has one time series per label
+func (prop *Property) Labeled() bool {
+	return prop.labeled
 }
 
+// escape label into valid file name
+// labels "." and ".." are escaped as well, so that they don't refer to other directories
+func escapeLabel(label string) (string, error) {
+	switch label {
+	case "":
+		return "", errors.New("Empty label")
+	case ".", "..":
+		return strings.Replace(label, ".", "%2E", -1), nil
+	}
+	return url.PathEscape(label), nil
+}
+
+// path of time series table of label
+func (prop *Property) labelDir(label string) (string, error) {
+	name, err := escapeLabel(label)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(prop.path, "labels", name), nil
+}
+
+// return property storing values of label, which is created if label is new
+// new labels beyond max number of labels are rejected with errTooManyLabels
+func (prop *Property) label(label string) (*Property, error) {
+	prop.mutex.Lock()
+	defer prop.mutex.Unlock()
+	if child, ok := prop.labels[label]; ok {
+		return child, nil
+	}
+	if prop.maxLabels > 0 && len(prop.labels) >= prop.maxLabels {
+		return nil, errTooManyLabels
+	}
+	dir, err := prop.labelDir(label)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := NewTimeSeriesTable(dir, prop.Levels)
+	if err != nil {
+		return nil, err
+	}
+	ts.TopLevel().LateWindow = prop.lateWindow
+	child := &Property{TS: ts, Kind: prop.Kind, Unit: prop.Unit, Scale: prop.Scale, Levels: prop.Levels,
+		lastSeen: time.Now()}
+	prop.labels[label] = child
+	return child, nil
+}
+
+// remove label and its time series
+func (prop *Property) removeLabel(label string) {
+	prop.mutex.Lock()
+	defer prop.mutex.Unlock()
+	if child, ok := prop.labels[label]; ok {
+		child.TS.Remove()
+		delete(prop.labels, label)
+		prop.capped = false
+	}
+}
+
+// create time series tables of labels stored previously
+func (prop *Property) loadLabels() error {
+	files, err := ioutil.ReadDir(filepath.Join(prop.path, "labels"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if label, err := url.PathUnescape(fi.Name()); err == nil && fi.IsDir() {
+			if _, err := prop.label(label); err == errTooManyLabels {
+				log.Printf("Skipped labels of %s beyond %d labels\n", prop.path, prop.maxLabels)
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sorted labels of property
+func (prop *Property) Labels() []string {
+	prop.mutex.Lock()
+	defer prop.mutex.Unlock()
+	labels := make([]string, 0, len(prop.labels))
+	for label := range prop.labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// time series table of label, nil if label is unknown
+func (prop *Property) LabelTS(label string) *TimeSeriesTable {
+	prop.mutex.Lock()
+	defer prop.mutex.Unlock()
+	if child, ok := prop.labels[label]; ok {
+		return child.TS
+	}
+	return nil
+}
+
+// remove time series of property and all its labels
+func (prop *Property) Remove() {
+	if prop.TS != nil {
+		prop.TS.Remove()
+	}
+	for _, label := range prop.Labels() {
+		prop.LabelTS(label).Remove()
+	}
+}
+
+// parse and scale sample of label, NaN if missing or not fully numeric, e.g. "476.9G"
+func (prop *Property) sample(vals map[string]string, label string) float64 {
+	val, found := vals[label]
+	if !found {
+		return math.NaN()
+	}
+	floatVal, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return floatVal * prop.Scale
+}
+
+// levels have same resolution and retention
+func sameLevels(a, b []TimeSeriesProps) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Resolution != b[i].Resolution || a[i].Retention != b[i].Retention {
+			return false
+		}
+	}
+	return true
+}
+
+// increase of counter which decreased from prev to cur
+// counters which were close to their 32 or 64 bit limit and are close to zero now are
+// assumed to have wrapped around, all others to have been reset
+// returns NaN on reset since increase is unknown
+func counterWrap(prev, cur float64) float64 {
+	for _, limit := range []float64{1 << 32, 1 << 64} {
+		if prev < limit && prev >= limit*3/4 && cur < limit/4 {
+			return limit - prev + cur
+		}
+	}
+	return math.NaN()
+}
+
+// store data point in time series table
+// failing data points are logged and skipped, e.g. late data points after clock was set back
+func storeDataPoint(tbl *TimeSeriesTable, t time.Time, val float64) {
+	if err := tbl.AddAt(t, val); err != nil {
+		log.Printf("Skipped data point of %s: %v\n", tbl.Path, err)
+	}
+}
+
+// convert sample of property into value to be stored
+// returns false for first sample of counters, which has no previous sample to compare with
+func (prop *Property) value(sample float64, now time.Time) (float64, bool) {
+	if prop.Kind != KindCounter && prop.Kind != KindDelta {
+		return sample, true
+	}
+	prev, prevTime := prop.prev, prop.prevTime
+	prop.prev, prop.prevTime = sample, now
+	if math.IsNaN(sample) {
+		// start over after gap
+		prop.prevTime = time.Time{}
+		return sample, true
+	}
+	if prevTime.IsZero() {
+		return 0, false
+	}
+	delta := sample - prev
+	if delta < 0 {
+		delta = counterWrap(prev, sample)
+	}
+	if prop.Kind == KindDelta {
+		return delta, true
+	}
+	if elapsed := now.Sub(prevTime).Seconds(); elapsed > 0 {
+		return delta / elapsed, true
+	}
+	return math.NaN(), true
+}
+
+// built-in properties recorded on each scheduled run of command handlers
+const (
+	PropExitCode    = "_exit_code"
+	PropDuration    = "_duration_seconds"
+	PropOutputBytes = "_output_bytes"
+	builtinPrefix   = "_"
+)
+
+// units of built-in properties
+var builtinProperties = map[string]string{
+	PropExitCode:    "",
+	PropDuration:    "seconds",
+	PropOutputBytes: "bytes",
+}
+
+// formats of command output
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
 // HTTP handler executing command line
 type CommandHandler struct {
 	HandlerImpl
+	// command line for display
 	CmdLine string
+	Command *Command
+	// format of command output, properties of JSON output are extracted by path
+	Format string
 	// map property name to regex and time series
-	Properties map[string]Property
-	Charts     []ChartConfig
-	Tmpl       *template.Template
+	Properties map[string]*Property
+	// names of properties derived by expression in order of evaluation
+	Derived []string
+	Charts  []ChartConfig
+	// map property name to alerts on property
+	Alerts map[string][]*Alert
+	Tmpl   *template.Template
+	// min interval between runs of command triggered by page views or run now
+	MinInterval time.Duration
+	// last result of command, guarded by mutex
+	mutex sync.Mutex
+	last  *CommandResult
+	// serializes runs triggered by page views
+	runMutex sync.Mutex
 }
 
 // compile regular expression and create time series tables
 func NewCommandHandler(conf HandlerConfig) (Handler, error) {
 	var pollInterval time.Duration
-	var propMap = make(map[string]Property)
+	var propMap = make(map[string]*Property)
+	var alertMap = make(map[string][]*Alert)
+	var derived = make([]string, 0)
 	var tmpl *template.Template
 	var err error
 
+	if conf.PollInterval != "" {
+		var err error
+
+		pollInterval, err = time.ParseDuration(conf.PollInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	command, err := NewCommand(conf)
+	if err != nil {
+		return nil, err
+	}
+	var minInterval = defaultMinInterval
+	if conf.MinInterval != "" {
+		if minInterval, err = ParseDuration(conf.MinInterval); err != nil {
+			return nil, err
+		}
+	}
+	cmdLine := conf.Cmd
+	if cmdLine == "" {
+		cmdLine = command.String()
+	}
+
+	format := strings.ToLower(conf.Format)
+	switch format {
+	case "":
+		format = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return nil, errors.New(fmt.Sprintf("Handler %s with unknown format %s", conf.Name, conf.Format))
+	}
+
+	var lateWindow time.Duration
+	if conf.LateWindow != "" {
+		if lateWindow, err = ParseDuration(conf.LateWindow); err != nil {
+			return nil, err
+		}
+	}
+
+	maxLabels := conf.MaxLabels
+	if maxLabels == 0 {
+		maxLabels = defaultMaxLabels
+	}
+	var labelExpiry time.Duration
+	if conf.LabelExpiry != "" {
+		if labelExpiry, err = ParseDuration(conf.LabelExpiry); err != nil {
+			return nil, err
+		}
+	}
+
+	// rolled up levels keep min and max by default
+	aggs := AggMin | AggMax
+	if conf.Aggregates != nil {
+		if aggs, err = ParseAggregates(conf.Aggregates); err != nil {
+			return nil, err
+		}
+	}
+	var tsProps []TimeSeriesProps
+	if conf.Retention != nil {
+		if tsProps, err = NewTimeSeriesProps(conf.Retention, pollInterval, aggs); err != nil {
+			return nil, errors.New(fmt.Sprintf("Retention of handler %s: %v", conf.Name, err))
+		}
+	} else if tsProps, err = DefaultTimeSeriesProps(pollInterval, aggs); err != nil {
+		return nil, err
+	}
+	// built-in properties are recorded on scheduled runs only
+	if pollInterval > 0 {
+		for name, unit := range builtinProperties {
+			ts, err := NewTimeSeriesTable(timeSeriesPath(conf.URL, name), tsProps)
+			if err != nil {
+				return nil, err
+			}
+			ts.TopLevel().LateWindow = lateWindow
+			propMap[name] = &Property{TS: ts, Kind: KindGauge, Unit: Units[unit], Scale: 1, Levels: tsProps,
+				labels: make(map[string]*Property)}
+		}
+	}
 	for _, propConfig := range conf.Properties {
+		var expr *Expr
+		var path, labelPath JSONPath
+
+		if strings.HasPrefix(propConfig.Name, builtinPrefix) {
+			return nil, errors.New(fmt.Sprintf("Property name %s is reserved, names must not start with %s",
+				propConfig.Name, builtinPrefix))
+		}
+		if propConfig.Expr != "" {
+			if propConfig.Regex != "" || propConfig.Path != "" {
+				return nil, errors.New(fmt.Sprintf("Property %s has both regex or path and expression",
+					propConfig.Name))
+			}
+			if expr, err = ParseExpr(propConfig.Expr); err != nil {
+				return nil, err
+			}
+		} else if format == FormatJSON {
+			if propConfig.Regex != "" {
+				return nil, errors.New(fmt.Sprintf("Property %s of JSON output has regex instead of path",
+					propConfig.Name))
+			}
+			if path, err = ParseJSONPath(propConfig.Path); err != nil {
+				return nil, err
+			}
+			if propConfig.Label != "" {
+				if !path.Wildcard() {
+					return nil, errors.New(fmt.Sprintf("Label of property %s requires wildcard in path",
+						propConfig.Name))
+				}
+				if labelPath, err = ParseJSONPath(propConfig.Label); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if format != FormatJSON && (propConfig.Path != "" || propConfig.Label != "") {
+			return nil, errors.New(fmt.Sprintf("Property %s has path but output isn't JSON", propConfig.Name))
+		}
 		if re, err := regexp.Compile(propConfig.Regex); err != nil {
 			return nil, err
 		} else {
 			prop := propConfig.Name
-			tsPath := filepath.Join(os.TempDir(), "mad", conf.URL, prop)
-			tsProps := []TimeSeriesProps{{60, 300}, {60, 300}, {60, 240}}
-			if ts, err := NewTimeSeriesTable(tsPath, tsProps); err != nil {
+			label, value, ok := regexGroups(re)
+			if !ok && expr == nil && path == nil {
+				return nil, errors.New(fmt.Sprintf("Regex of property %s needs one group for value "+
+					"or two groups for label and value", prop))
+			}
+			kind := strings.ToLower(propConfig.Kind)
+			switch kind {
+			case "":
+				kind = KindGauge
+			case KindGauge, KindCounter, KindDelta:
+			default:
+				return nil, errors.New(fmt.Sprintf("Property %s of unknown kind %s", prop, propConfig.Kind))
+			}
+			unit, err := ParseUnit(propConfig.Unit)
+			if err != nil {
+				return nil, err
+			}
+			if kind == KindCounter {
+				unit = unit.Rate()
+			}
+			scale := propConfig.Scale
+			if scale == 0 {
+				scale = 1
+			}
+			propProps := tsProps
+			if propConfig.Retention != nil {
+				if propProps, err = NewTimeSeriesProps(propConfig.Retention, pollInterval, aggs); err != nil {
+					return nil, errors.New(fmt.Sprintf("Retention of property %s of handler %s: %v",
+						prop, conf.Name, err))
+				}
+			}
+			propMap[prop] = &Property{Regex: re, Kind: kind, Unit: unit, Scale: scale, Levels: propProps,
+				labelGroup: label, valueGroup: value, labeled: label > 0, path: timeSeriesPath(conf.URL, prop),
+				lateWindow: lateWindow, labels: make(map[string]*Property), maxLabels: maxLabels,
+				labelExpiry: labelExpiry}
+			if labelExpiry == 0 {
+				// data points of labels missing for longer have expired on all levels
+				propMap[prop].labelExpiry = propProps[len(propProps)-1].Retention
+			}
+			if expr != nil {
+				propMap[prop].Regex, propMap[prop].Expr = nil, expr
+				propMap[prop].labelGroup, propMap[prop].valueGroup, propMap[prop].labeled = 0, 0, false
+			} else if path != nil {
+				propMap[prop].Regex, propMap[prop].Path, propMap[prop].LabelPath = nil, path, labelPath
+				propMap[prop].labelGroup, propMap[prop].valueGroup, propMap[prop].labeled = 0, 0, path.Wildcard()
+			}
+			if propMap[prop].Labeled() {
+				// labels are discovered in output
+				if err := propMap[prop].loadLabels(); err != nil {
+					return nil, err
+				}
+			} else if ts, err := NewTimeSeriesTable(propMap[prop].path, propProps); err != nil {
 				return nil, err
 			} else {
-				propMap[prop] = Property{Regex: re, TS: ts}
+				ts.TopLevel().LateWindow = lateWindow
+				propMap[prop].TS = ts
+			}
+		}
+	}
+	// expressions may refer to properties extracted by regex and previously derived ones
+	defined := make(map[string]bool)
+	for _, propConfig := range conf.Properties {
+		prop := propMap[propConfig.Name]
+		if prop.Expr == nil {
+			continue
+		}
+		for _, name := range prop.Expr.Vars() {
+			if ref, ok := propMap[name]; !ok || (ref.Expr != nil && !defined[name]) {
+				return nil, errors.New(fmt.Sprintf("Expression of property %s refers to unknown property %s",
+					propConfig.Name, name))
+			} else if ref.Labeled() {
+				return nil, errors.New(fmt.Sprintf("Expression of property %s refers to labeled property %s",
+					propConfig.Name, name))
 			}
 		}
+		derived = append(derived, propConfig.Name)
+		defined[propConfig.Name] = true
 	}
 
-	if conf.PollInterval != "" {
-		var err error
+	// charts show same levels and unit of all their properties
+	for _, chart := range conf.Charts {
+		var first *Property
 
-		pollInterval, err = time.ParseDuration(conf.PollInterval)
-		if err != nil {
+		for _, name := range chart.Properties {
+			prop, ok := propMap[name]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("Chart %s of unknown property %s", chart.Name, name))
+			}
+			if first == nil {
+				first = prop
+			} else if !sameLevels(first.Levels, prop.Levels) {
+				return nil, errors.New(fmt.Sprintf("Properties of chart %s have different retention",
+					chart.Name))
+			} else if first.Unit.Name != prop.Unit.Name {
+				return nil, errors.New(fmt.Sprintf("Properties of chart %s have different units %s and %s",
+					chart.Name, first.Unit, prop.Unit))
+			}
+		}
+	}
+
+	for _, alertConfig := range conf.Alerts {
+		prop, ok := propMap[alertConfig.Property]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Alert %s on unknown property %s",
+				alertConfig.Name, alertConfig.Property))
+		}
+		if alert, err := NewAlert(conf.URL, alertConfig); err != nil {
 			return nil, err
+		} else if prop.Labeled() {
+			// alerts on labels are created when label is first seen
+			prop.alerts = append(prop.alerts, alertConfig)
+		} else {
+			alertMap[alert.Property] = append(alertMap[alert.Property], alert)
+			RegisterAlert(alert)
 		}
 	}
 
@@ -122,33 +671,57 @@ func NewCommandHandler(conf HandlerConfig) (Handler, error) {
 					<caption> {{.Cmd}} Output </caption>
 					<tr> 
 						<td text-align: left>
+						{{if .Pretty}}
+						<pre> {{.Pretty}} </pre>
+						{{else}}
 						<code> {{ .FirstLine }} </code>
 						{{range .AdditionalLines}} <br> <code> {{.}} </code> {{end}}
+						{{end}}
 						</td>
 					</tr>
 				</table>
-				{{range .Charts}}
-				<h2 style="text-align:center"> {{.Name}} </h2>
-				<h3 style="text-align:center"> Last 5 minutes </h3>
-				<img src="{{.Path}}/2" alt="{{.Name}}" width="100%" style="border:1px solid black"> <br>
-				<h3 style="text-align:center"> Last 5 hours </h3>
-				<img src="{{.Path}}/1" alt="{{.Name}}" width="100%" style="border:1px solid black"> <br>
-				<h3 style="text-align:center"> Last 10 days </h3>
-				<img src="{{.Path}}/0" alt="{{.Name}}" width="100%" style="border:1px solid black"> <br>
+				<form action="{{.Path}}/run" method="post" style="text-align:center">
+					Collected {{.Result.Time.Format "2006-01-02 15:04:05"}} in {{.Result.Duration}},
+					exit code {{.Result.ExitCode}}
+					<input type="submit" value="Run now">
+				</form>
+				{{if .Result.Stderr}}
+				<br>
+				<table style="width:100%;border:1px solid black">
+					<caption> {{.Cmd}} Standard Error </caption>
+					<tr> <td text-align: left> <pre> {{.Result.Stderr}} </pre> </td> </tr>
+				</table>
+				{{end}}
+				{{range $chart := .Charts}}
+				<h2 style="text-align:center"> {{.Name}}{{if .Unit.Name}} ({{.Unit}}){{end}} </h2>
+				{{range .Levels}}
+				<h3 style="text-align:center"> {{.Title}} </h3>
+				<img src="{{$chart.Path}}/{{.ID}}" alt="{{$chart.Name}}" width="100%" style="border:1px solid black"> <br>
+				{{end}}
 				{{end}}
 			</body>
 		</html>
 	`
 
-	if tmpl, err = masterTempl.New("command").Parse(tmplStr); err != nil {
+	if tmpl, err = sharedTemplate("command", tmplStr); err != nil {
 		log.Fatal(err)
 	}
 
 	return &CommandHandler{HandlerImpl: HandlerImpl{conf.URL, conf.Name, pollInterval},
-			CmdLine: conf.Cmd, Properties: propMap, Charts: conf.Charts, Tmpl: tmpl},
+			CmdLine: cmdLine, Command: command, Format: format, Properties: propMap, Derived: derived, Charts: conf.Charts,
+			Alerts: alertMap, Tmpl: tmpl, MinInterval: minInterval},
 		nil
 }
 
+// parse template of handler type once, all handlers of same type share it
+// parsing it again would leave templates of previously created handlers incomplete
+func sharedTemplate(name, tmplStr string) (*template.Template, error) {
+	if tmpl := masterTempl.Lookup(name); tmpl != nil {
+		return tmpl, nil
+	}
+	return masterTempl.New(name).Parse(tmplStr)
+}
+
 func NewHandler(conf HandlerConfig) (Handler, error) {
 	if conf.Type == "" {
 		conf.Type = "command"
@@ -156,113 +729,450 @@ func NewHandler(conf HandlerConfig) (Handler, error) {
 	switch strings.ToLower(conf.Type) {
 	case "command":
 		return NewCommandHandler(conf)
+	case "nagios":
+		return NewNagiosHandler(conf)
 	}
 	return nil, errors.New(fmt.Sprintf("Unknown handler type %s", conf.Type))
 }
 
-func (handler CommandHandler) Stat() (string, map[string]string) {
-	var err error
-	// map property name to current value
-	var props = make(map[string]string)
-	// command output
-	var out []byte
+// result of running command of handler
+type CommandResult struct {
+	// command output or error message if command failed
+	Output string
+	// standard output even if command failed
+	Stdout string
+	Stderr string
+	// map property name and label to extracted value, nil if command failed
+	Props map[string]map[string]string
+	// exit code, -1 if command didn't exit normally, e.g. on timeout
+	ExitCode int
+	Err      error
+	// size of standard output
+	OutputBytes int
+	// time command got started and how long it ran
+	Time     time.Time
+	Duration time.Duration
+}
+
+// run command and extract property values from output
+// values are mapped by property name and label, which is empty for properties without label
+// last matching line wins if label occurs multiple times
+// properties of JSON output are extracted by path, no values are returned for invalid JSON
+// standard error is returned separately
+func (handler *CommandHandler) Stat() *CommandResult {
+	// map property name and label to current value
+	var props = make(map[string]map[string]string)
 
 	// execute command
-	cmd := strings.Split(handler.CmdLine, " ")
-	out, err = exec.Command(cmd[0], cmd[1:]...).Output()
-	if err != nil {
-		return fmt.Sprintf("Error executing command line \"%s\": %v\n", handler.CmdLine, err), nil
+	res := &CommandResult{Time: time.Now()}
+	out, stderr, err := handler.Command.Run()
+	res.Duration = time.Since(res.Time)
+	res.Stderr, res.ExitCode, res.Err = string(stderr), exitCode(err), err
+	res.Stdout, res.OutputBytes = string(out), len(out)
+	if err == ErrCommandTimeout {
+		log.Printf("Command line \"%s\" of %s timed out after %v\n", handler.CmdLine, handler.Path(),
+			handler.Command.Timeout)
+		res.Output = fmt.Sprintf("Command line \"%s\" timed out after %v, partial output:\n%s",
+			handler.CmdLine, handler.Command.Timeout, out)
+		return res
+	} else if err != nil {
+		res.Output = fmt.Sprintf("Error executing command line \"%s\": %v\n", handler.CmdLine, err)
+		return res
+	}
+
+	res.Output = string(out)
+	if handler.Format == FormatJSON {
+		var doc interface{}
+
+		if err := json.Unmarshal(out, &doc); err != nil {
+			res.Output = fmt.Sprintf("Invalid JSON output of command line \"%s\": %v\n%s", handler.CmdLine, err, out)
+			res.Err = err
+			return res
+		}
+		for name, prop := range handler.Properties {
+			if prop.Path != nil {
+				props[name] = prop.Path.Extract(doc, prop.LabelPath)
+			}
+		}
+		res.Props = props
+		return res
 	}
 
 	// parse/grep property values from command output
 	lines := strings.Split(string(out), "\n")
 	for name, prop := range handler.Properties {
+		if prop.Regex == nil {
+			continue
+		}
+		vals := make(map[string]string)
 		for _, line := range lines {
 			subMatches := prop.Regex.FindStringSubmatch(line)
-			// we only expect one group in regex
-			if len(subMatches) == 2 {
-				props[name] = subMatches[1]
+			if subMatches == nil {
+				continue
+			}
+			if prop.Labeled() {
+				vals[subMatches[prop.labelGroup]] = subMatches[prop.valueGroup]
+			} else {
+				vals[""] = subMatches[prop.valueGroup]
 			}
 		}
+		props[name] = vals
+	}
+	res.Props = props
+	return res
+}
+
+// keep result as last result unless a more recent one is kept already
+func (handler *CommandHandler) setLast(res *CommandResult) {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	if handler.last == nil || !res.Time.Before(handler.last.Time) {
+		handler.last = res
 	}
-	return string(out), props
 }
 
-// query properties and store them in time series logs
-func (handler CommandHandler) Execute() {
-	_, props := handler.Stat()
-	//fmt.Println(props)
-	for key, val := range props {
-		var floatVal float64
+// last result of command, nil if command didn't run yet
+func (handler *CommandHandler) Last() *CommandResult {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	return handler.last
+}
+
+// commands aren't run more often on page views and run now by default
+const defaultMinInterval = time.Second
+
+// result shown on page
+// polled handlers serve their last result, others run command unless it ran within min interval
+// command is run in any case if forced and min interval has passed
+// concurrent page views don't run command more than once
+func (handler *CommandHandler) Result(force bool) *CommandResult {
+	handler.runMutex.Lock()
+	defer handler.runMutex.Unlock()
+	if last := handler.Last(); last != nil {
+		if !force && handler.PollInterval() > 0 {
+			return last
+		}
+		if time.Since(last.Time) < handler.MinInterval {
+			return last
+		}
+	}
+	res := handler.Stat()
+	handler.setLast(res)
+	return res
+}
 
-		// map property name to time series
+// query properties, store them in time series logs and evaluate alerts
+// gaps are recorded for properties missing in output, e.g. if command failed
+// derived properties are computed from samples of other properties
+func (handler *CommandHandler) Execute() {
+	res := handler.Stat()
+	handler.setLast(res)
+	handler.record(res, time.Now())
+}
+
+// store properties and built-in properties of result
+func (handler *CommandHandler) record(res *CommandResult, now time.Time) {
+	var samples = make(map[string]float64)
+
+	props := res.Props
+	for key, prop := range handler.Properties {
+		if prop.Expr != nil || prop.Labeled() {
+			continue
+		}
+		samples[key] = prop.sample(props[key], "")
+	}
+	samples[PropExitCode] = float64(res.ExitCode)
+	samples[PropDuration] = res.Duration.Seconds()
+	samples[PropOutputBytes] = float64(res.OutputBytes)
+	for _, key := range handler.Derived {
 		prop := handler.Properties[key]
-		fmt.Sscanf(val, "%f", &floatVal)
-		prop.TS.Add(floatVal)
+		samples[key] = prop.Expr.Eval(samples) * prop.Scale
+	}
+	for key, prop := range handler.Properties {
+		if prop.Labeled() {
+			handler.addLabeled(key, prop, props[key], now)
+		} else {
+			handler.add(key, prop, samples[key], now)
+		}
 	}
 }
 
-func (handler CommandHandler) ServeChart(w http.ResponseWriter, req *http.Request, relPath string) {
-	w.Header().Set("Content-Type", "image/svg+xml")
-	var ts = make([]*TimeSeries, 0)
-	var legend = make([]string, 0)
-	var level int
+// store sample of property and evaluate alerts on it
+func (handler *CommandHandler) add(key string, prop *Property, sample float64, now time.Time) {
+	val, ok := prop.value(sample, now)
+	if !ok {
+		return
+	}
+	storeDataPoint(prop.TS, now, val)
+	for _, alert := range handler.Alerts[key] {
+		alert.Evaluate(val, now)
+	}
+}
+
+// store samples of all labels of property
+// new labels get time series and alerts created, labels missing in output get a single gap
+// and are removed after label expiry
+// alerts on labels are keyed by property name and label, e.g. "Util/sda"
+func (handler *CommandHandler) addLabeled(name string, prop *Property, vals map[string]string, now time.Time) {
+	for label := range vals {
+		if _, err := prop.label(label); err == errTooManyLabels {
+			if !prop.capped {
+				log.Printf("Dropping new labels of %s beyond %d labels\n", name, prop.maxLabels)
+				prop.capped = true
+			}
+		} else if err != nil {
+			log.Printf("Failed to create time series of %s/%s: %v\n", name, label, err)
+		}
+	}
+	for _, label := range prop.Labels() {
+		child, _ := prop.label(label)
+		key := name + "/" + label
+		if _, found := vals[label]; found {
+			child.present, child.lastSeen = true, now
+		} else if child.present {
+			child.present = false
+		} else {
+			if now.Sub(child.lastSeen) > prop.labelExpiry {
+				for _, alert := range handler.Alerts[key] {
+					alert.Resolve(now)
+					UnregisterAlert(alert)
+				}
+				delete(handler.Alerts, key)
+				prop.removeLabel(label)
+			}
+			continue
+		}
+		if _, ok := handler.Alerts[key]; !ok {
+			handler.Alerts[key] = make([]*Alert, 0, len(prop.alerts))
+			for _, alertConfig := range prop.alerts {
+				alertConfig.Property = key
+				// config was validated when handler got created
+				alert, _ := NewAlert(handler.Path(), alertConfig)
+				handler.Alerts[key] = append(handler.Alerts[key], alert)
+				RegisterAlert(alert)
+			}
+		}
+		handler.add(key, child, prop.sample(vals, label), now)
+	}
+}
+
+// parse time range from query parameters, either "last" as duration up to now, e.g. "7d"
+// or "from" and optionally "to" as RFC 3339 or "2006-01-02 15:04" local time
+func ParseTimeRange(req *http.Request) (from, to time.Time, err error) {
+	parseTime := func(s string) (time.Time, error) {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, nil
+		}
+		return time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	}
+
+	query := req.URL.Query()
+	to = time.Now()
+	if s := query.Get("to"); s != "" {
+		if to, err = parseTime(s); err != nil {
+			return
+		}
+	}
+	if s := query.Get("last"); s != "" {
+		var last time.Duration
+
+		if last, err = ParseDuration(s); err != nil {
+			return
+		}
+		from = to.Add(-last)
+	} else if s := query.Get("from"); s != "" {
+		if from, err = parseTime(s); err != nil {
+			return
+		}
+	} else {
+		err = errors.New("Time range requires \"last\" or \"from\" parameter")
+	}
+	return
+}
+
+// chart section showing one level of time series table
+type ChartLevel struct {
+	// index of level in time series table
+	ID    int
+	Title string
+}
+
+// chart sections of time series levels from finest to coarsest level
+// IDs index levels of time series table, which starts with coarsest level
+func chartLevels(tsProps []TimeSeriesProps) []ChartLevel {
+	var levels = make([]ChartLevel, 0, len(tsProps))
+
+	for i, prop := range tsProps {
+		levels = append(levels, ChartLevel{ID: len(tsProps) - 1 - i, Title: "Last " + humanDuration(prop.Retention)})
+	}
+	return levels
+}
+
+// human readable duration in largest whole unit, e.g. "5 minutes", "hour" or "10 days"
+func humanDuration(d time.Duration) string {
+	var units = []struct {
+		unit time.Duration
+		name string
+	}{{24 * time.Hour, "day"}, {time.Hour, "hour"}, {time.Minute, "minute"}, {time.Second, "second"}}
+
+	for _, u := range units {
+		if d < u.unit || d%u.unit != 0 {
+			continue
+		}
+		if n := d / u.unit; n > 1 {
+			return fmt.Sprintf("%d %ss", n, u.name)
+		}
+		return u.name
+	}
+	return d.String()
+}
+
+// read data points for chart from given level of time series table
+// levels are read for their retention period up to now
+// level "range" selects finest level covering time range given by query parameters
+// min/max band is drawn if level stores min and max unless query parameter "band" is false
+func chartData(name string, tbl *TimeSeriesTable, level string, req *http.Request) (PlotData, error) {
+	var ts *TimeSeries
+	var data []DataPoint
+	var id int
+	var err error
+
+	if level == "range" {
+		var from, to time.Time
+
+		if from, to, err = ParseTimeRange(req); err != nil {
+			return PlotData{}, err
+		}
+		ts = tbl.LevelFor(from)
+		data, err = ts.ReadRange(from, to)
+	} else {
+		if n, _ := fmt.Sscanf(level, "%d", &id); n != 1 || id < 0 || id >= len(tbl.TS) {
+			return PlotData{}, errors.New(fmt.Sprintf("Invalid level %s", level))
+		}
+		ts = tbl.TS[id]
+		now := time.Now()
+		data, err = ts.ReadRange(now.Add(-ts.Retention), now)
+	}
+	band := ts.Aggregates&(AggMin|AggMax) == AggMin|AggMax && req.URL.Query().Get("band") != "false"
+	return PlotData{Name: name, Data: data, Band: band}, err
+}
+
+func (handler *CommandHandler) ServeChart(w http.ResponseWriter, req *http.Request, relPath string) {
+	var data = make([]PlotData, 0)
 
 	comps := strings.Split(relPath, "/")
 	if len(comps) != 2 {
-		fmt.Fprintf(w, "Invalid Path")
+		http.Error(w, "Invalid Path", http.StatusNotFound)
 		return
 	}
 
-	chartName, levelStr := comps[0], comps[1]
-	fmt.Sscanf(levelStr, "%d", &level)
+	chartName, level := comps[0], comps[1]
 	for _, chart := range handler.Charts {
-		if chart.Name == chartName {
-			for _, prop := range chart.Properties {
-				ts = append(ts, handler.Properties[prop].TS.TS[level])
-				legend = append(legend, prop)
+		if chart.Name != chartName {
+			continue
+		}
+		for _, name := range chart.Properties {
+			prop := handler.Properties[name]
+			names, tables := []string{name}, []*TimeSeriesTable{prop.TS}
+			if prop.Labeled() {
+				// show all labels discovered so far, named by label only if chart has single property
+				names, tables = nil, nil
+				for _, label := range prop.Labels() {
+					if len(chart.Properties) > 1 {
+						names = append(names, name+"/"+label)
+					} else {
+						names = append(names, label)
+					}
+					tables = append(tables, prop.LabelTS(label))
+				}
+			}
+			for i, tbl := range tables {
+				if tmp, err := chartData(names[i], tbl, level, req); err == nil {
+					tmp.Unit = prop.Unit
+					data = append(data, tmp)
+				} else {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
 			}
-			break
 		}
+		break
 	}
-	PlotTimeSeries(w, ts, legend)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	PlotTimeSeries(w, data)
 }
 
-func (handler CommandHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (handler *CommandHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	type Chart struct {
-		Path string
-		Name string
+		Path   string
+		Name   string
+		Unit   Unit
+		Levels []ChartLevel
 	}
 
 	type Page struct {
+		Path            string
 		Cmd             string
 		FirstLine       string
 		AdditionalLines []string
-		Charts          []Chart
+		// indented JSON output
+		Pretty string
+		Result *CommandResult
+		Charts []Chart
 	}
 
 	if relPath, err := filepath.Rel(handler.Path(), req.URL.Path); err == nil {
 		fmt.Printf("URL=%s, relPath=%s\n", req.URL.Path, relPath)
-		if relPath != "." {
+		if relPath == "run" {
+			if req.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			// run command now and show its result
+			handler.Result(true)
+			http.Redirect(w, req, handler.Path(), http.StatusSeeOther)
+			return
+		} else if relPath != "." {
 			handler.ServeChart(w, req, relPath)
 			return
 		}
 	}
 
-	out, _ := handler.Stat()
+	res := handler.Result(false)
+	out := res.Output
 	charts := make([]Chart, 0)
 	for _, chart := range handler.Charts {
+		var levels []ChartLevel
+		var unit Unit
+
 		imgPath := filepath.Join(handler.Path(), chart.Name)
-		charts = append(charts, Chart{Path: imgPath, Name: chart.Name})
+		// properties of chart share time series levels and unit
+		if len(chart.Properties) > 0 {
+			if prop, ok := handler.Properties[chart.Properties[0]]; ok {
+				levels = chartLevels(prop.Levels)
+				unit = prop.Unit
+			}
+		}
+		charts = append(charts, Chart{Path: imgPath, Name: chart.Name, Unit: unit, Levels: levels})
 	}
 	lines := strings.Split(out, "\n")
-	page := Page{Cmd: handler.CmdLine,
+	page := Page{Path: handler.Path(),
+		Cmd:       handler.CmdLine,
 		FirstLine: lines[0],
+		Result:    res,
 		Charts:    charts}
 	if len(lines) > 1 {
 		page.AdditionalLines = lines[1:]
 	}
+	if handler.Format == FormatJSON && res.Err == nil {
+		var buf bytes.Buffer
+
+		if err := json.Indent(&buf, []byte(out), "", "  "); err == nil {
+			page.Pretty = buf.String()
+		}
+	}
 	if err := handler.Tmpl.Execute(w, page); err != nil {
 		log.Fatal(err)
 	}
@@ -308,7 +1218,7 @@ func (handler ConfigHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	if req.URL.Path == txtPath {
 		if f, err := os.Open(handler.ConfigPath); err == nil {
 			if _, err := io.Copy(w, f); err != nil {
-				fmt.Println("Failed to read %s: %v", handler.ConfigPath, err)
+				fmt.Printf("Failed to read %s: %v\n", handler.ConfigPath, err)
 			}
 		} else {
 			fmt.Fprintf(w, "Couldn't open %s: %v", handler.ConfigPath, err)
@@ -383,16 +1293,16 @@ type CPULoadHandler struct {
 	Tmpl     *template.Template
 }
 
-func timeSeriesPath(url, prop string) string {
-	return filepath.Join(os.TempDir(), "mad", url, prop)
-}
-
 func NewCPULoadHandler() (Handler, error) {
 	var userTS, systemTS, idleTS *TimeSeriesTable
 	var url = "/cpu"
 	var err error
 
-	tsProps := []TimeSeriesProps{{60, 300}, {60, 300}, {60, 240}}
+	pollInterval, _ := time.ParseDuration("1s")
+	tsProps, err := DefaultTimeSeriesProps(pollInterval, AggMin|AggMax)
+	if err != nil {
+		return nil, err
+	}
 	if userTS, err = NewTimeSeriesTable(timeSeriesPath(url, "user"), tsProps); err != nil {
 		return nil, err
 	}
@@ -402,7 +1312,6 @@ func NewCPULoadHandler() (Handler, error) {
 	if idleTS, err = NewTimeSeriesTable(timeSeriesPath(url, "idle"), tsProps); err != nil {
 		return nil, err
 	}
-	pollInterval, _ := time.ParseDuration("1s")
 	const tmplStr = `
 		<!DOCTYPE html>
 		<html>
@@ -412,13 +1321,11 @@ func NewCPULoadHandler() (Handler, error) {
 			</head>
 			<body>
 				{{template "header"}}
-				<h1 style="text-align:center"> CPU Load </h1>
-				<h2 style="text-align:center"> Last 5 Minutes </h2>
-				<img src="{{.}}/2" width="100%" style="border:1px solid black"> <br>
-				<h2 style="text-align:center"> Last 5 Hours </h2>
-				<img src="{{.}}/1" width="100%" style="border:1px solid black"> <br>
-				<h2 style="text-align:center"> Last 10 Days </h2>
-				<img src="{{.}}/0" width="100%" style="border:1px solid black"> <br>
+				<h1 style="text-align:center"> CPU Load (percent) </h1>
+				{{range .Levels}}
+				<h2 style="text-align:center"> {{.Title}} </h2>
+				<img src="{{$.Path}}/{{.ID}}" width="100%" style="border:1px solid black"> <br>
+				{{end}}
 			</body>
 		</html>	`
 	if tmpl, err := masterTempl.New("cpu").Parse(tmplStr); err != nil {
@@ -439,35 +1346,115 @@ func (handler *CPULoadHandler) Execute() {
 	//	rd.Stats[USER], rd.Stats[SYSTEM], rd.Stats[IDLE], diff.Total())
 	handler.Load = curr
 
-	if err := handler.UserTS.Add(rd.Stats[USER]); err != nil {
-		log.Fatal(err)
-	}
-	if err := handler.SystemTS.Add(rd.Stats[SYSTEM]); err != nil {
-		log.Fatal(err)
-	}
-	if err := handler.IdleTS.Add(rd.Stats[IDLE]); err != nil {
-		log.Fatal(err)
-	}
+	now := time.Now()
+	storeDataPoint(handler.UserTS, now, rd.Stats[USER])
+	storeDataPoint(handler.SystemTS, now, rd.Stats[SYSTEM])
+	storeDataPoint(handler.IdleTS, now, rd.Stats[IDLE])
 }
 
 func (handler *CPULoadHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if relPath, err := filepath.Rel(handler.Path(), req.URL.Path); err == nil {
 		if relPath != "." {
-			var level int
-
-			w.Header().Set("Content-Type", "image/svg+xml")
-			fmt.Sscan(relPath, &level)
-			if level < len(handler.UserTS.TS) {
-				PlotTimeSeries(w, []*TimeSeries{handler.UserTS.TS[level],
-					handler.SystemTS.TS[level],
-					handler.IdleTS.TS[level]},
-					[]string{"user", "system", "idle"})
+			var data = make([]PlotData, 0)
+			var names = []string{"user", "system", "idle"}
+
+			for i, tbl := range []*TimeSeriesTable{handler.UserTS, handler.SystemTS, handler.IdleTS} {
+				if tmp, err := chartData(names[i], tbl, relPath, req); err == nil {
+					// load is stored as fraction
+					tmp.Unit = Units["ratio"]
+					data = append(data, tmp)
+				} else {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
 			}
+			w.Header().Set("Content-Type", "image/svg+xml")
+			PlotTimeSeries(w, data)
 			return
 		}
 	}
 
-	if err := handler.Tmpl.Execute(w, handler.Path()); err != nil {
+	type Page struct {
+		Path   string
+		Levels []ChartLevel
+	}
+
+	page := Page{Path: handler.Path(), Levels: chartLevels(handler.UserTS.Props())}
+	if err := handler.Tmpl.Execute(w, page); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// HTTP handler listing active and resolved alerts
+type AlertHandler struct {
+	HandlerImpl
+	Tmpl *template.Template
+}
+
+func NewAlertHandler() Handler {
+	const tmplStr = `
+		<!DOCTYPE html>
+		<html>
+			<head>
+			{{template "style"}}
+			<title> Alerts </title>
+			</head>
+			<body>
+				{{template "header"}}
+				<h1 style="text-align:center"> Alerts </h1>
+				<table style="width:100%;border:1px solid black">
+					<caption> Active Alerts </caption>
+					<tr> <th> Alert </th> <th> State </th> <th> Handler </th> <th> Property </th>
+						<th> Value </th> <th> Condition </th> <th> Since </th> </tr>
+					{{range .Active}}
+					<tr> <td> {{.Name}} </td> <td> {{.State}} </td> <td> <a href="{{.Handler}}"> {{.Handler}} </a> </td>
+						<td> {{.Property}} </td> <td> {{.Value}} </td> <td> {{.Op}} {{.Threshold}} </td>
+						<td> {{.Start.Format "2006-01-02 15:04:05"}} </td> </tr>
+					{{end}}
+				</table>
+				<br>
+				<table style="width:100%;border:1px solid black">
+					<caption> Resolved Alerts </caption>
+					<tr> <th> Alert </th> <th> Handler </th> <th> Property </th>
+						<th> Value </th> <th> Condition </th> <th> Start </th> <th> End </th> </tr>
+					{{range .Resolved}}
+					<tr> <td> {{.Name}} </td> <td> <a href="{{.Handler}}"> {{.Handler}} </a> </td>
+						<td> {{.Property}} </td> <td> {{.Value}} </td> <td> {{.Op}} {{.Threshold}} </td>
+						<td> {{.Start.Format "2006-01-02 15:04:05"}} </td>
+						<td> {{.End.Format "2006-01-02 15:04:05"}} </td> </tr>
+					{{end}}
+				</table>
+			</body>
+		</html>	`
+
+	if tmpl, err := masterTempl.New("alerts").Parse(tmplStr); err != nil {
+		log.Fatal(err)
+		return nil
+	} else {
+		return &AlertHandler{HandlerImpl: HandlerImpl{"/alerts", "Alerts", 0}, Tmpl: tmpl}
+	}
+}
+
+func (handler AlertHandler) Execute() {
+}
+
+// serve alert page or alerts as JSON under sub path "api"
+func (handler AlertHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	type Page struct {
+		Active   []AlertEvent
+		Resolved []AlertEvent
+	}
+
+	page := Page{Active: ActiveAlerts(), Resolved: ResolvedAlerts()}
+	if req.URL.Path == filepath.Join(handler.Path(), "api") {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(page); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if err := handler.Tmpl.Execute(w, page); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -486,8 +1473,18 @@ func NewRootHandler() Handler {
 			</head>
 			<body>
 				<h1> Registered Commands </h1>
-				<div> </div>
-				{{range .}} <a href="{{.Path}}"> {{.Name}} </a> <br>
+				{{if .Firing}}
+				<div style="background-color:red;color:white;padding:10px">
+					<a href="/alerts" style="color:white"> {{.Firing}} alert(s) firing </a>
+				</div>
+				{{else}}
+				<div style="background-color:green;color:white;padding:10px">
+					<a href="/alerts" style="color:white"> No alerts firing </a>
+				</div>
+				{{end}}
+				<br>
+				{{range .Entries}} <a href="{{.Path}}"> {{.Name}} </a>
+				{{if .State}} <span style="color:{{.Color}}"> {{.State}} </span> {{end}} <br>
 				{{end}}
 			</body>
 		</html>
@@ -505,6 +1502,14 @@ func (handler RootHandler) Execute() {
 
 type Entry struct {
 	Path, Name string
+	// state of handlers reporting one, e.g. "OK" of nagios checks
+	State, Color string
+}
+
+// handler reporting state shown on root page
+type StateReporter interface {
+	// state and its color, empty if unknown
+	State() (string, string)
 }
 
 // implement sort interface on []Entry
@@ -516,19 +1521,29 @@ func (a ByName) Less(i, j int) bool { return a[i].Path < a[j].Path }
 
 // root handler listing all other handlers
 func (handler RootHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	type Page struct {
+		Entries []Entry
+		Firing  int
+	}
 
 	entries := make([]Entry, 0, len(Registry))
 	for path, entry := range Registry {
-		entries = append(entries, Entry{path, entry.Name()})
+		e := Entry{Path: path, Name: entry.Name()}
+		if reporter, ok := entry.(StateReporter); ok {
+			e.State, e.Color = reporter.State()
+		}
+		entries = append(entries, e)
 	}
 
 	sort.Sort(ByName(entries))
-	if err := handler.Tmpl.Execute(w, entries); err != nil {
+	page := Page{Entries: entries, Firing: FiringAlertCount()}
+	if err := handler.Tmpl.Execute(w, page); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func init() {
+// template set holding header and style shared by all pages
+func newMasterTemplate() *template.Template {
 	const headerStr = `
 		<div style="background-color:powderblue; font-size:20px;border:20px solid powderblue">
 		<a href="/" style="padding: 21px 50px 21px 20px;"> Monitoring and Alerting Daemon </a>
@@ -537,17 +1552,21 @@ func init() {
 		</div>
 		<br>
 	`
-	
+
 	const styleStr = `
 		<style>
 		body 	{background-color: white;}
 		</style>
 	`
 
-	if templ, err := template.New("header").Parse(headerStr); err != nil {
+	templ, err := template.New("header").Parse(headerStr)
+	if err != nil {
 		log.Fatal(err)
-	} else {
-		masterTempl = templ
 	}
-	masterTempl.New("style").Parse(styleStr)
+	templ.New("style").Parse(styleStr)
+	return templ
+}
+
+func init() {
+	masterTempl = newMasterTemplate()
 }
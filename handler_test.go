@@ -0,0 +1,480 @@
+// Copyright (C) 2016, Heiko Koehler
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// time series of tests are stored in temporary data directory
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "mad-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	DataDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestCounterProperties(t *testing.T) {
+	start := time.Now()
+	counter := &Property{Kind: KindCounter}
+	delta := &Property{Kind: KindDelta}
+	gauge := &Property{Kind: KindGauge}
+
+	var tests = []struct {
+		sample  float64
+		offset  time.Duration
+		rate    float64
+		stored  bool
+		comment string
+	}{
+		{100, 0, 0, false, "first sample has no rate"},
+		{300, 10 * time.Second, 20, true, "increase"},
+		{300, 20 * time.Second, 0, true, "no increase"},
+		{math.NaN(), 30 * time.Second, math.NaN(), true, "gap"},
+		{400, 40 * time.Second, 0, false, "first sample after gap"},
+		{50, 50 * time.Second, math.NaN(), true, "reset"},
+		{4294967050, 60 * time.Second, 429496700, true, "large 32 bit counter"},
+		{104, 70 * time.Second, 35, true, "32 bit wrap around"},
+	}
+	for _, test := range tests {
+		now := start.Add(test.offset)
+		rate, stored := counter.value(test.sample, now)
+		if stored != test.stored || (stored && !(rate == test.rate ||
+			math.IsNaN(rate) && math.IsNaN(test.rate))) {
+			t.Fatalf("%s: stored %v rate %f", test.comment, stored, rate)
+		}
+		if d, ok := delta.value(test.sample, now); ok && !math.IsNaN(d) && d != test.rate*10 {
+			t.Fatalf("%s: delta %f", test.comment, d)
+		}
+		if v, ok := gauge.value(test.sample, now); !ok || !(v == test.sample || math.IsNaN(v)) {
+			t.Fatalf("%s: gauge %f", test.comment, v)
+		}
+	}
+
+	if _, err := NewCommandHandler(HandlerConfig{Name: "Bad", URL: "/test/kind", Cmd: "true",
+		Properties: []PropertyConfig{{Name: "p", Regex: "(.*)", Kind: "histogram"}}}); err == nil {
+		t.Fatal("accepted unknown property kind")
+	}
+}
+
+func TestDerivedProperties(t *testing.T) {
+	conf := HandlerConfig{Name: "Memory", URL: "/test/derived", Cmd: "echo used 30 free 10",
+		Properties: []PropertyConfig{
+			{Name: "Percent", Expr: "Used / Total * 100"},
+			{Name: "Used", Regex: "used (\\d+)"},
+			{Name: "Free", Regex: "free (\\d+)"},
+			{Name: "Total", Expr: "Used + Free"},
+		}}
+	if _, err := NewCommandHandler(conf); err == nil {
+		t.Fatal("accepted reference to property derived later")
+	}
+
+	conf.Properties[0], conf.Properties[3] = conf.Properties[3], conf.Properties[0]
+	handler, err := NewCommandHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, prop := range handler.(*CommandHandler).Properties {
+			prop.TS.Remove()
+		}
+	}()
+	handler.Execute()
+	data, err := handler.(*CommandHandler).Properties["Percent"].TS.TopLevel().ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || data[0].Val != 75 {
+		t.Fatalf("unexpected derived data points %+v", data)
+	}
+
+	conf.Properties[0].Expr = "Used + Unknown"
+	if _, err := NewCommandHandler(conf); err == nil {
+		t.Fatal("accepted reference to unknown property")
+	}
+}
+
+func TestLabeledProperties(t *testing.T) {
+	conf := HandlerConfig{Name: "Disks", URL: "/test/labeled", Cmd: "printf '%s\\n%s\\n' sda=10 sdb=20",
+		Properties: []PropertyConfig{
+			{Name: "Util", Regex: "(\\w+)=(\\d+)"},
+			{Name: "Named", Regex: "(?P<value>\\d+)$|^(?P<label>\\w+)"},
+			{Name: "Total", Expr: "Util * 2"},
+		},
+		Alerts: []AlertConfig{{Name: "Busy", Property: "Util", Op: ">", Threshold: 15}},
+	}
+	if _, err := NewCommandHandler(conf); err == nil {
+		t.Fatal("accepted expression over labeled property")
+	}
+	conf.Properties[1].Regex = "(\\w+)=(\\d+)=(\\d+)"
+	conf.Properties = conf.Properties[:2]
+	if _, err := NewCommandHandler(conf); err == nil {
+		t.Fatal("accepted regex with three groups")
+	}
+
+	conf.Properties[1].Regex = "^(?P<label>\\w+)=(?P<value>\\d+)"
+	h, err := NewCommandHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*CommandHandler)
+	defer func() {
+		for _, prop := range handler.Properties {
+			prop.Remove()
+		}
+	}()
+	handler.Execute()
+	handler.Command.Args = []string{"echo", "sda=30"}
+	handler.Execute()
+	handler.Execute()
+
+	for _, name := range []string{"Util", "Named"} {
+		prop := handler.Properties[name]
+		if labels := prop.Labels(); len(labels) != 2 || labels[0] != "sda" || labels[1] != "sdb" {
+			t.Fatalf("unexpected labels %v of %s", labels, name)
+		}
+		sda, _ := prop.LabelTS("sda").TopLevel().ReadAll()
+		sdb, _ := prop.LabelTS("sdb").TopLevel().ReadAll()
+		if len(sda) != 3 || sda[0].Val != 10 || sda[2].Val != 30 {
+			t.Fatalf("unexpected data points of sda %+v", sda)
+		}
+		// missing label gets single gap
+		if len(sdb) != 2 || sdb[0].Val != 20 || !sdb[1].IsGap() {
+			t.Fatalf("unexpected data points of sdb %+v", sdb)
+		}
+	}
+	if alerts := handler.Alerts["Util/sdb"]; len(alerts) != 1 || alerts[0].State != AlertFiring {
+		t.Fatalf("unexpected alerts %+v on label", alerts)
+	}
+	if alerts := handler.Alerts["Util/sda"]; len(alerts) != 1 || alerts[0].Property != "Util/sda" {
+		t.Fatalf("unexpected alerts %+v on label", alerts)
+	}
+
+	// labels are restored from disk
+	for _, prop := range handler.Properties {
+		for _, label := range prop.Labels() {
+			prop.LabelTS(label).Close()
+		}
+	}
+	if h, err = NewCommandHandler(conf); err != nil {
+		t.Fatal(err)
+	}
+	handler = h.(*CommandHandler)
+	if labels := handler.Properties["Util"].Labels(); len(labels) != 2 {
+		t.Fatalf("labels %v not restored", labels)
+	}
+}
+
+func TestLabelLimits(t *testing.T) {
+	for label, name := range map[string]string{"sda": "sda", "a/b": "a%2Fb", ".": "%2E", "..": "%2E%2E"} {
+		if escaped, err := escapeLabel(label); err != nil || escaped != name {
+			t.Fatalf("escaped label %s as %s: %v", label, escaped, err)
+		}
+	}
+	if _, err := escapeLabel(""); err == nil {
+		t.Fatal("accepted empty label")
+	}
+
+	conf := HandlerConfig{Name: "Procs", URL: "/test/labellimits", Cmd: "printf '%s\\n' ..=1 =2 a=3 b=4",
+		Properties: []PropertyConfig{{Name: "CPU", Regex: "^([^=]*)=(\\d+)"}},
+		Alerts:     []AlertConfig{{Name: "Busy", Property: "CPU", Op: ">", Threshold: 0}},
+		MaxLabels:  2, LabelExpiry: "1m"}
+	h, err := NewCommandHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*CommandHandler)
+	prop := handler.Properties["CPU"]
+	defer os.RemoveAll(prop.path)
+	defer func() {
+		for _, prop := range handler.Properties {
+			prop.Remove()
+		}
+	}()
+	fds, _ := ioutil.ReadDir("/proc/self/fd")
+	now := time.Now()
+	handler.record(handler.Stat(), now)
+	if labels := prop.Labels(); len(labels) != 2 {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(prop.path, "labels")); len(files) != 2 {
+		t.Fatalf("%d time series of 2 labels", len(files))
+	}
+
+	// labels missing for longer than label expiry are removed
+	handler.Command.Args = []string{"true"}
+	handler.record(handler.Stat(), now.Add(30*time.Second))
+	if labels := prop.Labels(); len(labels) != 2 {
+		t.Fatalf("labels %v removed before expiry", labels)
+	}
+	handler.record(handler.Stat(), now.Add(2*time.Minute))
+	if labels := prop.Labels(); len(labels) != 0 {
+		t.Fatalf("labels %v not expired", labels)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(prop.path, "labels")); len(files) != 0 {
+		t.Fatalf("time series of %d expired labels not removed", len(files))
+	}
+	// firing alerts of expired labels are resolved
+	for _, ev := range ActiveAlerts() {
+		if ev.Handler == "/test/labellimits" {
+			t.Fatalf("alert %s on %s still active", ev.Name, ev.Property)
+		}
+	}
+	var resolved int
+	for _, ev := range ResolvedAlerts() {
+		if ev.Handler == "/test/labellimits" && ev.State == AlertResolved && !ev.End.IsZero() {
+			resolved++
+		}
+	}
+	if resolved != 2 {
+		t.Fatalf("%d alerts of expired labels resolved", resolved)
+	}
+	// logs of expired labels are closed
+	if tmp, _ := ioutil.ReadDir("/proc/self/fd"); len(tmp) > len(fds) {
+		t.Fatalf("%d open files after labels expired, %d before", len(tmp), len(fds))
+	}
+}
+
+func TestJSONProperties(t *testing.T) {
+	conf := HandlerConfig{Name: "Disks", URL: "/test/json", Format: "json",
+		Cmd: `echo '{"load": 1.5, "size": "476.9G", "disks": [{"name": "sda", "util": 10}, {"name": "sdb", "util": 20}]}'`,
+		Properties: []PropertyConfig{
+			{Name: "Load", Path: "load"},
+			{Name: "Util", Path: "disks.*.util", Label: "name"},
+			{Name: "Size", Path: "size"},
+		},
+	}
+	h, err := NewCommandHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*CommandHandler)
+	defer func() {
+		for _, prop := range handler.Properties {
+			prop.Remove()
+		}
+	}()
+	handler.Execute()
+	if data, _ := handler.Properties["Load"].TS.TopLevel().ReadAll(); len(data) != 1 || data[0].Val != 1.5 {
+		t.Fatalf("unexpected data points %+v", data)
+	}
+	if data, _ := handler.Properties["Util"].LabelTS("sdb").TopLevel().ReadAll(); len(data) != 1 || data[0].Val != 20 {
+		t.Fatalf("unexpected data points %+v", data)
+	}
+	// values which aren't fully numeric are stored as gaps
+	if data, _ := handler.Properties["Size"].TS.TopLevel().ReadAll(); len(data) != 1 || !data[0].IsGap() {
+		t.Fatalf("unexpected data points %+v", data)
+	}
+
+	conf.Properties[0].Label = "name"
+	if _, err := NewCommandHandler(conf); err == nil {
+		t.Fatal("accepted label of path without wildcard")
+	}
+	conf.Properties[0] = PropertyConfig{Name: "Load", Regex: "load\":([\\d.]+)"}
+	if _, err := NewCommandHandler(conf); err == nil {
+		t.Fatal("accepted regex on JSON output")
+	}
+	conf.Format = "text"
+	if _, err := NewCommandHandler(conf); err == nil {
+		t.Fatal("accepted path on text output")
+	}
+}
+
+func TestCommandResult(t *testing.T) {
+	conf := HandlerConfig{Name: "Counter", URL: "/test/cached", Cmd: "date +%s%N", MinInterval: "1h"}
+	h, err := NewCommandHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*CommandHandler)
+	res := handler.Result(false)
+	if res.ExitCode != 0 || res.Output == "" || res.Time.IsZero() {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if handler.Result(false) != res || handler.Result(true) != res {
+		t.Fatal("command ran again within min interval")
+	}
+	handler.MinInterval = 0
+	if handler.Result(false) == res {
+		t.Fatal("command didn't run again")
+	}
+
+	// polled handlers serve result of last scheduled run unless run now
+	conf.PollInterval, conf.MinInterval = "1h", ""
+	if h, err = NewCommandHandler(conf); err != nil {
+		t.Fatal(err)
+	}
+	handler = h.(*CommandHandler)
+	defer func() {
+		for _, prop := range handler.Properties {
+			prop.Remove()
+		}
+	}()
+	handler.Execute()
+	res = handler.Last()
+	if handler.Result(false) != res {
+		t.Fatal("command ran again on page view")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/test/cached/run", nil))
+	if w.Code != http.StatusSeeOther || handler.Last() != res {
+		t.Fatalf("command ran now within default min interval, status %d", w.Code)
+	}
+	handler.MinInterval = 0
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/test/cached/run", nil))
+	if w.Code != http.StatusMethodNotAllowed || handler.Last() != res {
+		t.Fatalf("command ran now on GET, status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/test/cached/run", nil))
+	if w.Code != http.StatusSeeOther || handler.Last() == res {
+		t.Fatalf("command didn't run now, status %d", w.Code)
+	}
+
+	handler.Command.Args = []string{"sh", "-c", "exit 3"}
+	if res = handler.Result(true); res.ExitCode != 3 || res.Props != nil {
+		t.Fatalf("unexpected result %+v of failed command", res)
+	}
+}
+
+func TestBuiltinProperties(t *testing.T) {
+	conf := HandlerConfig{Name: "Failing", URL: "/test/builtin", Cmd: "sh -c 'echo hello; exit 2'",
+		PollInterval: "1m",
+		Properties:   []PropertyConfig{{Name: "Doubled", Expr: "_output_bytes * 2"}},
+		Charts:       []ChartConfig{{Name: "Duration", Properties: []string{PropDuration}}},
+		Alerts:       []AlertConfig{{Name: "Failed", Property: PropExitCode, Op: "!=", Threshold: 0}},
+	}
+	h, err := NewCommandHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*CommandHandler)
+	defer func() {
+		for _, prop := range handler.Properties {
+			prop.Remove()
+		}
+	}()
+	handler.Execute()
+	for name, val := range map[string]float64{PropExitCode: 2, PropOutputBytes: 6, "Doubled": 12} {
+		data, _ := handler.Properties[name].TS.TopLevel().ReadAll()
+		if len(data) != 1 || data[0].Val != val {
+			t.Fatalf("unexpected data points %+v of %s", data, name)
+		}
+	}
+	if data, _ := handler.Properties[PropDuration].TS.TopLevel().ReadAll(); len(data) != 1 || data[0].Val <= 0 {
+		t.Fatalf("unexpected duration %+v", data)
+	}
+	if alert := handler.Alerts[PropExitCode][0]; alert.State != AlertFiring {
+		t.Fatalf("alert %s not firing", alert.Name)
+	}
+
+	conf.Properties = []PropertyConfig{{Name: "_mine", Regex: "(\\d+)"}}
+	if _, err := NewCommandHandler(conf); err == nil {
+		t.Fatal("accepted reserved property name")
+	}
+
+	// handlers without poll interval have no built-in properties
+	conf.Properties, conf.Charts, conf.Alerts, conf.PollInterval = nil, nil, nil, ""
+	if h, err = NewCommandHandler(conf); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.(*CommandHandler).Properties) != 0 {
+		t.Fatalf("unexpected properties %v of handler without poll interval", h.(*CommandHandler).Properties)
+	}
+}
+
+func TestLateDataPoints(t *testing.T) {
+	conf := HandlerConfig{Name: "Clock", URL: "/test/late", Cmd: "echo 42",
+		Properties: []PropertyConfig{{Name: "Answer", Regex: "(\\d+)"}}}
+	h, err := NewCommandHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*CommandHandler)
+	defer func() {
+		for _, prop := range handler.Properties {
+			prop.Remove()
+		}
+	}()
+	now := time.Now()
+	res := handler.Stat()
+	handler.record(res, now)
+	// clock set back, late data points are skipped
+	handler.record(res, now.Add(-time.Hour))
+	data, err := handler.Properties["Answer"].TS.TopLevel().ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || data[0].Val != 42 {
+		t.Fatalf("unexpected data points %+v", data)
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	parse := func(query string) (time.Time, time.Time, error) {
+		return ParseTimeRange(httptest.NewRequest("GET", "/test/range/Load/range?"+query, nil))
+	}
+
+	if from, to, err := parse("last=7d"); err != nil {
+		t.Fatal(err)
+	} else if to.Sub(from) != 7*24*time.Hour || time.Since(to) > time.Minute {
+		t.Fatalf("unexpected range %v - %v", from, to)
+	}
+	from, to, err := parse("from=2016-05-01T10:00:00Z&to=2016-05-02T10:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	} else if !from.Equal(time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)) ||
+		!to.Equal(time.Date(2016, 5, 2, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected range %v - %v", from, to)
+	}
+	if from, _, err := parse("from=2016-05-01+10:00"); err != nil {
+		t.Fatal(err)
+	} else if !from.Equal(time.Date(2016, 5, 1, 10, 0, 0, 0, time.Local)) {
+		t.Fatalf("unexpected local start %v", from)
+	}
+	for _, query := range []string{"", "to=2016-05-02T10:00:00Z", "last=7x", "from=yesterday"} {
+		if _, _, err := parse(query); err == nil {
+			t.Fatalf("accepted time range %q", query)
+		}
+	}
+
+	conf := HandlerConfig{Name: "Range", URL: "/test/range", Cmd: "echo 0.5",
+		Properties: []PropertyConfig{{Name: "Load", Regex: "([\\d.]+)"}},
+		Charts:     []ChartConfig{{Name: "Load", Properties: []string{"Load"}}}}
+	h, err := NewCommandHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*CommandHandler)
+	defer func() {
+		for _, prop := range handler.Properties {
+			prop.Remove()
+		}
+	}()
+	handler.Execute()
+	for query, code := range map[string]int{
+		"last=7d": http.StatusOK,
+		"from=2016-05-01T10:00:00Z&to=2016-05-02T10:00:00Z": http.StatusOK,
+		"": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/test/range/Load/range?"+query, nil))
+		if w.Code != code {
+			t.Fatalf("range %q returned status %d, expected %d", query, w.Code, code)
+		}
+	}
+}
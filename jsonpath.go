@@ -0,0 +1,134 @@
+// Copyright (C) 2016, Heiko Koehler
+// extract property values from JSON output of commands
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// path of object keys and array indexes separated by dots, e.g. "blockdevices.0.size"
+// wildcard "*" matches all elements of arrays and objects, e.g. "blockdevices.*.size"
+type JSONPath []string
+
+// parse path with optional "$." prefix
+func ParseJSONPath(s string) (JSONPath, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "$"), ".")
+	if s == "" {
+		return nil, errors.New("Empty JSON path")
+	}
+	path := JSONPath(strings.Split(s, "."))
+	for _, comp := range path {
+		if comp == "" {
+			return nil, errors.New(fmt.Sprintf("Empty component in JSON path %s", s))
+		}
+	}
+	return path, nil
+}
+
+// path contains wildcard, i.e. matches values of multiple labels
+func (path JSONPath) Wildcard() bool {
+	for _, comp := range path {
+		if comp == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (path JSONPath) String() string {
+	return strings.Join(path, ".")
+}
+
+// string of numeric value, booleans are 1 or 0, other values are invalid
+// strings are returned as is since they might be labels, samples have to be fully numeric
+func jsonValue(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case float64:
+		return strconv.FormatFloat(val, 'g', -1, 64), true
+	case string:
+		return val, true
+	case bool:
+		if val {
+			return "1", true
+		}
+		return "0", true
+	}
+	return "", false
+}
+
+// child of object or array element
+func jsonChild(doc interface{}, comp string) (interface{}, bool) {
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[comp]
+		return child, ok
+	case []interface{}:
+		if i, err := strconv.Atoi(comp); err == nil && i >= 0 && i < len(node) {
+			return node[i], true
+		}
+	}
+	return nil, false
+}
+
+// values at path mapped by label
+// labels of wildcard matches are array indexes or object keys joined by "/", the component of
+// last wildcard is replaced by value at label path relative to matched element if given
+// values of paths without wildcard have empty label
+func (path JSONPath) Extract(doc interface{}, label JSONPath) map[string]string {
+	var vals = make(map[string]string)
+	var walk func(node interface{}, i int, labels []string)
+
+	walk = func(node interface{}, i int, labels []string) {
+		if i == len(path) {
+			if val, ok := jsonValue(node); ok {
+				vals[strings.Join(labels, "/")] = val
+			}
+			return
+		}
+		if path[i] != "*" {
+			if child, ok := jsonChild(node, path[i]); ok {
+				walk(child, i+1, labels)
+			}
+			return
+		}
+		// label by relative path if no more wildcards follow
+		byLabel := label != nil && !path[i+1:].Wildcard()
+		visit := func(key string, child interface{}) {
+			if byLabel {
+				if val, ok := label.value(child); ok {
+					key = val
+				} else {
+					return
+				}
+			}
+			walk(child, i+1, append(labels[:len(labels):len(labels)], key))
+		}
+		switch node := node.(type) {
+		case map[string]interface{}:
+			for key, child := range node {
+				visit(key, child)
+			}
+		case []interface{}:
+			for j, child := range node {
+				visit(strconv.Itoa(j), child)
+			}
+		}
+	}
+	walk(doc, 0, nil)
+	return vals
+}
+
+// single value at path without wildcards
+func (path JSONPath) value(doc interface{}) (string, bool) {
+	for _, comp := range path {
+		var ok bool
+
+		if doc, ok = jsonChild(doc, comp); !ok {
+			return "", false
+		}
+	}
+	return jsonValue(doc)
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2016, Heiko Koehler
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONPath(t *testing.T) {
+	const doc = `{"load": 0.5, "up": true, "name": "host",
+		"blockdevices": [{"name": "sda", "size": 100, "parts": {"sda1": {"size": 60}, "sda2": {"size": 40}}},
+			{"name": "sdb", "size": "200"}]}`
+	var tree interface{}
+
+	if err := json.Unmarshal([]byte(doc), &tree); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		path  string
+		label string
+		vals  map[string]string
+	}{
+		{"load", "", map[string]string{"": "0.5"}},
+		{"$.up", "", map[string]string{"": "1"}},
+		{"blockdevices.1.size", "", map[string]string{"": "200"}},
+		{"blockdevices.2.size", "", map[string]string{}},
+		{"blockdevices", "", map[string]string{}},
+		{"blockdevices.*.size", "", map[string]string{"0": "100", "1": "200"}},
+		{"blockdevices.*.size", "name", map[string]string{"sda": "100", "sdb": "200"}},
+		{"blockdevices.*.parts.*.size", "", map[string]string{"0/sda1": "60", "0/sda2": "40"}},
+	}
+	for _, test := range tests {
+		var label JSONPath
+
+		path, err := ParseJSONPath(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.label != "" {
+			label, _ = ParseJSONPath(test.label)
+		}
+		vals := path.Extract(tree, label)
+		if len(vals) != len(test.vals) {
+			t.Fatalf("%s: unexpected values %v", test.path, vals)
+		}
+		for key, val := range test.vals {
+			if vals[key] != val {
+				t.Fatalf("%s: unexpected values %v", test.path, vals)
+			}
+		}
+	}
+	for _, s := range []string{"", "$", "a..b"} {
+		if _, err := ParseJSONPath(s); err == nil {
+			t.Fatalf("accepted invalid path %s", s)
+		}
+	}
+}
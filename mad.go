@@ -20,6 +20,7 @@ import (
 func main() {
 	flag.StringVar(&ConfigPath, "config", "/etc/mad.json", "Path to confg file")
 	flag.IntVar(&Port, "port", 8080, "Server port")
+	flag.StringVar(&DataDir, "data-dir", DataDir, "Directory storing time series")
 	flag.Parse()
 	log.Printf("Config path: %s", ConfigPath)
 
@@ -31,6 +32,8 @@ func main() {
 		RegisterHandler(configHandler)
 		rootHandler := NewRootHandler()
 		RegisterHandler(rootHandler)
+		alertHandler := NewAlertHandler()
+		RegisterHandler(alertHandler)
 		cpuHandler, _ := NewCPULoadHandler()
 		RegisterHandler(cpuHandler)
 	}
@@ -0,0 +1,558 @@
+// Copyright (C) 2016, Heiko Koehler
+// handler running Nagios compatible check plugins
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// state of check given by exit code of plugin
+type NagiosState int
+
+const (
+	NagiosOK NagiosState = iota
+	NagiosWarning
+	NagiosCritical
+	NagiosUnknown
+)
+
+func (state NagiosState) String() string {
+	switch state {
+	case NagiosOK:
+		return "OK"
+	case NagiosWarning:
+		return "WARNING"
+	case NagiosCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+// color of state on pages
+func (state NagiosState) Color() string {
+	switch state {
+	case NagiosOK:
+		return "green"
+	case NagiosWarning:
+		return "orange"
+	case NagiosCritical:
+		return "red"
+	}
+	return "gray"
+}
+
+// state of plugin exit code, plugins which failed or exited with other codes are unknown
+func nagiosState(exitCode int) NagiosState {
+	if exitCode < int(NagiosOK) || exitCode > int(NagiosUnknown) {
+		return NagiosUnknown
+	}
+	return NagiosState(exitCode)
+}
+
+// performance data of single label, e.g. "load1=0.5;1;2;0;"
+type PerfData struct {
+	Label string
+	// value in unit of measurement, NaN if unknown
+	Value float64
+	UOM   string
+	// warning and critical ranges, e.g. "10", "10:", "~:10" or "@10:20"
+	Warn, Crit string
+}
+
+var perfValueRegex = regexp.MustCompile(`^([-+]?[0-9.]+(?:[eE][-+]?[0-9]+)?)([a-zA-Z%]*)$`)
+
+// parse space separated performance data
+// labels containing spaces are quoted by single quotes, values which can't be parsed are skipped
+func ParsePerfData(s string) []PerfData {
+	var perf = make([]PerfData, 0)
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		var label string
+
+		if s[0] == '\'' {
+			// quotes within label are doubled
+			var buf bytes.Buffer
+			var i int
+
+			for i = 1; i < len(s); i++ {
+				if s[i] == '\'' && strings.HasPrefix(s[i:], "''") {
+					i++
+				} else if s[i] == '\'' {
+					break
+				}
+				buf.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++
+			}
+			label, s = buf.String(), s[i:]
+		} else {
+			end := strings.IndexAny(s, "= ")
+			if end < 0 {
+				break
+			}
+			label, s = s[:end], s[end:]
+		}
+		if !strings.HasPrefix(s, "=") {
+			// skip malformed token
+			if end := strings.IndexByte(s, ' '); end >= 0 {
+				s = s[end:]
+				continue
+			}
+			break
+		}
+		spec := s[1:]
+		if end := strings.IndexByte(spec, ' '); end >= 0 {
+			spec, s = spec[:end], spec[end:]
+		} else {
+			s = ""
+		}
+		fields := strings.Split(spec, ";")
+		pd := PerfData{Label: label, Value: math.NaN()}
+		if fields[0] != "U" {
+			m := perfValueRegex.FindStringSubmatch(fields[0])
+			if m == nil {
+				continue
+			}
+			pd.Value, _ = strconv.ParseFloat(m[1], 64)
+			pd.UOM = m[2]
+		}
+		if len(fields) > 1 {
+			pd.Warn = fields[1]
+		}
+		if len(fields) > 2 {
+			pd.Crit = fields[2]
+		}
+		perf = append(perf, pd)
+	}
+	return perf
+}
+
+// split plugin output into text and performance data
+// performance data follows "|" on first line and on first line of long text containing "|",
+// in which case all following lines are performance data as well
+func ParsePluginOutput(out string) (string, []PerfData) {
+	var text, perf []string
+
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if i := strings.IndexByte(lines[0], '|'); i >= 0 {
+		text = append(text, strings.TrimSpace(lines[0][:i]))
+		perf = append(perf, lines[0][i+1:])
+	} else {
+		text = append(text, lines[0])
+	}
+	for j, line := range lines[1:] {
+		if i := strings.IndexByte(line, '|'); i >= 0 {
+			text = append(text, line[:i])
+			perf = append(perf, line[i+1:])
+			perf = append(perf, lines[j+2:]...)
+			break
+		}
+		text = append(text, line)
+	}
+	return strings.Join(text, "\n"), ParsePerfData(strings.Join(perf, " "))
+}
+
+// boundaries of threshold range, infinite boundaries and implicit start 0 are omitted
+func rangeBounds(r string) []float64 {
+	var bounds = make([]float64, 0, 2)
+
+	r = strings.TrimPrefix(r, "@")
+	if r == "" {
+		return bounds
+	}
+	parts := strings.SplitN(r, ":", 2)
+	if len(parts) == 1 {
+		parts = []string{"", parts[0]}
+	}
+	for _, part := range parts {
+		if v, err := strconv.ParseFloat(part, 64); err == nil {
+			bounds = append(bounds, v)
+		}
+	}
+	return bounds
+}
+
+// unit, scale and kind of property storing values of unit of measurement
+// continuous counters "c" are stored as rate
+func perfUnit(uom string) (Unit, float64, string) {
+	switch uom {
+	case "s":
+		return Units["seconds"], 1, KindGauge
+	case "ms":
+		return Units["seconds"], 1e-3, KindGauge
+	case "us":
+		return Units["seconds"], 1e-6, KindGauge
+	case "%":
+		return Units["percent"], 1, KindGauge
+	case "c":
+		return Units[""].Rate(), 1, KindCounter
+	}
+	for i, prefix := range []string{"", "K", "M", "G", "T"} {
+		if strings.ToUpper(uom) == prefix+"B" {
+			return Units["bytes"], math.Pow(1024, float64(i)), KindGauge
+		}
+	}
+	return Units[""], 1, KindGauge
+}
+
+// file in time series table of performance data storing its unit of measurement
+const perfUOMFile = "UOM"
+
+// property storing performance data of label
+type perfProperty struct {
+	*Property
+	// boundaries of warning and critical range in unit of property
+	Warn, Crit []float64
+}
+
+// HTTP handler running check plugin
+// state and performance data are shown on page, performance data of each label is stored on
+// scheduled runs as property created when label first appears
+type NagiosHandler struct {
+	*CommandHandler
+	levels     []TimeSeriesProps
+	lateWindow time.Duration
+	// max number of labels and how long missing labels are kept, like labels of properties
+	maxLabels   int
+	labelExpiry time.Duration
+	// map label to property, guarded by mutex
+	mutex  sync.Mutex
+	perf   map[string]*perfProperty
+	capped bool
+	Tmpl   *template.Template
+}
+
+func NewNagiosHandler(conf HandlerConfig) (Handler, error) {
+	var tmpl *template.Template
+	var err error
+
+	if conf.Properties != nil || conf.Charts != nil {
+		return nil, errors.New(fmt.Sprintf("Nagios handler %s has properties or charts, "+
+			"performance data is stored automatically", conf.Name))
+	}
+	if conf.PollInterval == "" {
+		return nil, errors.New(fmt.Sprintf("Nagios handler %s without poll interval, "+
+			"performance data is stored on scheduled runs", conf.Name))
+	}
+	h, err := NewCommandHandler(conf)
+	if err != nil {
+		return nil, err
+	}
+	cmdHandler := h.(*CommandHandler)
+	// performance data is stored with same levels as built-in properties
+	builtin := cmdHandler.Properties[PropExitCode]
+
+	const tmplStr = `
+		<!DOCTYPE html>
+		<html>
+			<head>
+			{{template "style"}}
+			<title> {{.Name}} </title>
+			</head>
+			<body>
+				{{template "header"}}
+				<h1 style="text-align:center"> {{.Name}} </h1>
+				<div style="background-color:{{.Color}};color:white;padding:10px">
+					{{.State}}: {{.FirstLine}}
+				</div>
+				{{range .AdditionalLines}} <code> {{.}} </code> <br> {{end}}
+				<br>
+				<form action="{{.Path}}/run" method="post" style="text-align:center">
+					{{.Cmd}} collected {{.Result.Time.Format "2006-01-02 15:04:05"}} in {{.Result.Duration}},
+					exit code {{.Result.ExitCode}}
+					<input type="submit" value="Run now">
+				</form>
+				{{if .Result.Stderr}}
+				<br>
+				<table style="width:100%;border:1px solid black">
+					<caption> {{.Cmd}} Standard Error </caption>
+					<tr> <td text-align: left> <pre> {{.Result.Stderr}} </pre> </td> </tr>
+				</table>
+				{{end}}
+				{{range $chart := .Charts}}
+				<h2 style="text-align:center"> {{.Label}}{{if .Unit.Name}} ({{.Unit}}){{end}} </h2>
+				{{range .Levels}}
+				<h3 style="text-align:center"> {{.Title}} </h3>
+				<img src="{{$.Path}}/chart/{{.ID}}?label={{$chart.Label}}" alt="{{$chart.Label}}" width="100%" style="border:1px solid black"> <br>
+				{{end}}
+				{{end}}
+			</body>
+		</html>
+	`
+
+	if tmpl, err = sharedTemplate("nagios", tmplStr); err != nil {
+		log.Fatal(err)
+	}
+	handler := &NagiosHandler{CommandHandler: cmdHandler, levels: builtin.Levels,
+		lateWindow: builtin.TS.TopLevel().LateWindow, maxLabels: conf.MaxLabels,
+		perf: make(map[string]*perfProperty), Tmpl: tmpl}
+	if handler.maxLabels == 0 {
+		handler.maxLabels = defaultMaxLabels
+	}
+	// label expiry was validated by command handler
+	if handler.labelExpiry, _ = ParseDuration(conf.LabelExpiry); handler.labelExpiry == 0 {
+		handler.labelExpiry = handler.levels[len(handler.levels)-1].Retention
+	}
+	if err := handler.loadPerfData(); err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+// create time series tables of performance data stored previously
+func (handler *NagiosHandler) loadPerfData() error {
+	dir := timeSeriesPath(handler.Path(), "perfdata")
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if label, err := url.PathUnescape(fi.Name()); err == nil && fi.IsDir() {
+			uom, _ := ioutil.ReadFile(filepath.Join(dir, fi.Name(), perfUOMFile))
+			if _, err := handler.perfProperty(PerfData{Label: label, UOM: string(uom)}); err == errTooManyLabels {
+				log.Printf("Skipped performance data of %s beyond %d labels\n", handler.Path(), handler.maxLabels)
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// return property of performance data, which is created if label is new
+// unit of measurement of new labels is stored along with their time series
+// new labels beyond max number of labels are rejected with errTooManyLabels
+func (handler *NagiosHandler) perfProperty(pd PerfData) (*perfProperty, error) {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	if prop, ok := handler.perf[pd.Label]; ok {
+		return prop, nil
+	}
+	if len(handler.perf) >= handler.maxLabels {
+		return nil, errTooManyLabels
+	}
+	unit, scale, kind := perfUnit(pd.UOM)
+	name, err := escapeLabel(pd.Label)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := NewTimeSeriesTable(filepath.Join(timeSeriesPath(handler.Path(), "perfdata"), name),
+		handler.levels)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(ts.Path, perfUOMFile), []byte(pd.UOM), false); err != nil {
+		return nil, err
+	}
+	ts.TopLevel().LateWindow = handler.lateWindow
+	prop := &perfProperty{Property: &Property{TS: ts, Kind: kind, Unit: unit, Scale: scale,
+		Levels: handler.levels, lastSeen: time.Now()}}
+	handler.perf[pd.Label] = prop
+	return prop, nil
+}
+
+// sorted labels of performance data
+func (handler *NagiosHandler) Labels() []string {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	labels := make([]string, 0, len(handler.perf))
+	for label := range handler.perf {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// property of label and copy of its thresholds, nil if label is unknown
+func (handler *NagiosHandler) PerfProperty(label string) (*Property, []float64, []float64) {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	if prop, ok := handler.perf[label]; ok {
+		return prop.Property, append([]float64(nil), prop.Warn...), append([]float64(nil), prop.Crit...)
+	}
+	return nil, nil, nil
+}
+
+// run plugin, store built-in properties and performance data
+// labels missing in output get a single gap and are removed after label expiry
+func (handler *NagiosHandler) Execute() {
+	res := handler.Stat()
+	handler.setLast(res)
+	now := time.Now()
+	handler.record(res, now)
+	handler.recordPerfData(res, now)
+}
+
+// store performance data of result
+func (handler *NagiosHandler) recordPerfData(res *CommandResult, now time.Time) {
+	_, perf := ParsePluginOutput(res.Stdout)
+	found := make(map[string]bool)
+	for _, pd := range perf {
+		prop, err := handler.perfProperty(pd)
+		if err == errTooManyLabels {
+			handler.mutex.Lock()
+			if !handler.capped {
+				log.Printf("Dropping new performance data of %s beyond %d labels\n", handler.Path(),
+					handler.maxLabels)
+				handler.capped = true
+			}
+			handler.mutex.Unlock()
+			continue
+		} else if err != nil {
+			log.Printf("Failed to create time series of %s/%s: %v\n", handler.Path(), pd.Label, err)
+			continue
+		}
+		found[pd.Label] = true
+		handler.mutex.Lock()
+		prop.present, prop.lastSeen = true, now
+		prop.Warn, prop.Crit = prop.bounds(pd.Warn), prop.bounds(pd.Crit)
+		handler.mutex.Unlock()
+		if val, ok := prop.value(pd.Value*prop.Scale, now); ok {
+			storeDataPoint(prop.TS, now, val)
+		}
+	}
+	for _, label := range handler.Labels() {
+		if found[label] {
+			continue
+		}
+		handler.mutex.Lock()
+		prop := handler.perf[label]
+		present := prop.present
+		prop.present = false
+		expired := !present && now.Sub(prop.lastSeen) > handler.labelExpiry
+		if expired {
+			delete(handler.perf, label)
+			handler.capped = false
+		}
+		handler.mutex.Unlock()
+		if expired {
+			prop.TS.Remove()
+		} else if present {
+			if val, ok := prop.value(math.NaN(), now); ok {
+				storeDataPoint(prop.TS, now, val)
+			}
+		}
+	}
+}
+
+// threshold boundaries of range in unit of property
+// thresholds of counters apply to raw values and aren't drawn
+func (prop *perfProperty) bounds(r string) []float64 {
+	if prop.Kind == KindCounter {
+		return nil
+	}
+	bounds := rangeBounds(r)
+	for i := range bounds {
+		bounds[i] *= prop.Scale
+	}
+	return bounds
+}
+
+// state and color of last result for root page, empty if plugin didn't run yet
+func (handler *NagiosHandler) State() (string, string) {
+	if res := handler.Last(); res != nil {
+		state := nagiosState(res.ExitCode)
+		return state.String(), state.Color()
+	}
+	return "", ""
+}
+
+// serve chart of label with warning and critical thresholds
+func (handler *NagiosHandler) ServeChart(w http.ResponseWriter, req *http.Request, level string) {
+	label := req.URL.Query().Get("label")
+	prop, warn, crit := handler.PerfProperty(label)
+	if prop == nil {
+		http.Error(w, fmt.Sprintf("Unknown label %s", label), http.StatusNotFound)
+		return
+	}
+	data, err := chartData(label, prop.TS, level, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data.Unit = prop.Unit
+	for _, v := range warn {
+		data.Lines = append(data.Lines, PlotLine{Name: "warning", Value: v, Color: "ffa500"})
+	}
+	for _, v := range crit {
+		data.Lines = append(data.Lines, PlotLine{Name: "critical", Value: v, Color: "ff0000"})
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	PlotTimeSeries(w, []PlotData{data})
+}
+
+func (handler *NagiosHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	type Chart struct {
+		Label  string
+		Unit   Unit
+		Levels []ChartLevel
+	}
+
+	type Page struct {
+		Path            string
+		Name            string
+		Cmd             string
+		State           NagiosState
+		Color           string
+		FirstLine       string
+		AdditionalLines []string
+		Result          *CommandResult
+		Charts          []Chart
+	}
+
+	if relPath, err := filepath.Rel(handler.Path(), req.URL.Path); err == nil {
+		if relPath == "run" {
+			if req.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			handler.Result(true)
+			http.Redirect(w, req, handler.Path(), http.StatusSeeOther)
+			return
+		} else if strings.HasPrefix(relPath, "chart/") {
+			handler.ServeChart(w, req, strings.TrimPrefix(relPath, "chart/"))
+			return
+		} else if relPath != "." {
+			http.Error(w, "Invalid Path", http.StatusNotFound)
+			return
+		}
+	}
+
+	res := handler.Result(false)
+	state := nagiosState(res.ExitCode)
+	text := res.Output
+	if res.ExitCode >= 0 {
+		text, _ = ParsePluginOutput(res.Stdout)
+	}
+	lines := strings.Split(text, "\n")
+	page := Page{Path: handler.Path(), Name: handler.Name(), Cmd: handler.CmdLine, State: state,
+		Color: state.Color(), FirstLine: lines[0], AdditionalLines: lines[1:], Result: res}
+	for _, label := range handler.Labels() {
+		prop, _, _ := handler.PerfProperty(label)
+		page.Charts = append(page.Charts, Chart{Label: label, Unit: prop.Unit, Levels: chartLevels(prop.Levels)})
+	}
+	if err := handler.Tmpl.Execute(w, page); err != nil {
+		log.Fatal(err)
+	}
+}
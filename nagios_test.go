@@ -0,0 +1,172 @@
+// Copyright (C) 2016, Heiko Koehler
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPluginOutput(t *testing.T) {
+	out := "DISK OK - free space: / 3326 MB (56%) | /=2643MB;5948;5958;0;5968 'my disk'=10%;;;\n" +
+		"long text\n" +
+		"more text | load1=0.5;1;2;0; time=U\n" +
+		"'it''s'=3c\n"
+	text, perf := ParsePluginOutput(out)
+	if text != "DISK OK - free space: / 3326 MB (56%)\nlong text\nmore text " {
+		t.Fatalf("unexpected text %q", text)
+	}
+	var expected = []PerfData{
+		{"/", 2643, "MB", "5948", "5958"},
+		{"my disk", 10, "%", "", ""},
+		{"load1", 0.5, "", "1", "2"},
+		{"time", math.NaN(), "", "", ""},
+		{"it's", 3, "c", "", ""},
+	}
+	if len(perf) != len(expected) {
+		t.Fatalf("unexpected performance data %+v", perf)
+	}
+	for i, pd := range perf {
+		exp := expected[i]
+		if pd.Label != exp.Label || pd.UOM != exp.UOM || pd.Warn != exp.Warn || pd.Crit != exp.Crit ||
+			!(pd.Value == exp.Value || math.IsNaN(pd.Value) && math.IsNaN(exp.Value)) {
+			t.Fatalf("unexpected performance data %+v instead of %+v", pd, exp)
+		}
+	}
+
+	var ranges = []struct {
+		r      string
+		bounds []float64
+	}{
+		{"", nil}, {"10", []float64{10}}, {"10:", []float64{10}}, {"~:10", []float64{10}},
+		{"@10:20", []float64{10, 20}},
+	}
+	for _, test := range ranges {
+		bounds := rangeBounds(test.r)
+		if len(bounds) != len(test.bounds) {
+			t.Fatalf("unexpected bounds %v of range %s", bounds, test.r)
+		}
+		for i := range bounds {
+			if bounds[i] != test.bounds[i] {
+				t.Fatalf("unexpected bounds %v of range %s", bounds, test.r)
+			}
+		}
+	}
+}
+
+func TestNagiosHandler(t *testing.T) {
+	conf := HandlerConfig{Name: "Disk", URL: "/test/nagios", Type: "nagios", Shell: true, PollInterval: "1m",
+		Cmd: "echo 'DISK WARNING - free 10% | /=2643MB;3000;4000;0; load1=0.5;1;2;0; ..=3 =4'; exit 1"}
+	h, err := NewHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*NagiosHandler)
+	defer func() {
+		for _, prop := range handler.Properties {
+			prop.Remove()
+		}
+		for _, label := range handler.Labels() {
+			prop, _, _ := handler.PerfProperty(label)
+			prop.Remove()
+		}
+	}()
+	if state, _ := handler.State(); state != "" {
+		t.Fatalf("unexpected state %s before first run", state)
+	}
+	handler.Execute()
+	if state, color := handler.State(); state != "WARNING" || color != "orange" {
+		t.Fatalf("unexpected state %s", state)
+	}
+	// labels are stored within perfdata directory, empty labels are skipped
+	if labels := handler.Labels(); len(labels) != 3 || labels[0] != ".." || labels[1] != "/" ||
+		labels[2] != "load1" {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+	if prop, _, _ := handler.PerfProperty(".."); filepath.Dir(prop.TS.Path) !=
+		timeSeriesPath(handler.Path(), "perfdata") {
+		t.Fatalf("time series of label .. stored in %s", prop.TS.Path)
+	}
+	prop, warn, crit := handler.PerfProperty("/")
+	data, _ := prop.TS.TopLevel().ReadAll()
+	if len(data) != 1 || data[0].Val != 2643*1024*1024 || prop.Unit.Name != "bytes" {
+		t.Fatalf("unexpected data points %+v in %s", data, prop.Unit)
+	}
+	if len(warn) != 1 || warn[0] != 3000*1024*1024 || len(crit) != 1 || crit[0] != 4000*1024*1024 {
+		t.Fatalf("unexpected thresholds %v, %v", warn, crit)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/test/nagios/chart/0?label=%2F", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d of chart", w.Code)
+	}
+
+	// performance data is restored from disk with its unit
+	for _, label := range handler.Labels() {
+		prop, _, _ := handler.PerfProperty(label)
+		prop.TS.Close()
+	}
+	if h, err = NewHandler(conf); err != nil {
+		t.Fatal(err)
+	}
+	if labels := h.(*NagiosHandler).Labels(); len(labels) != 3 {
+		t.Fatalf("labels %v not restored", labels)
+	}
+	if prop, _, _ := h.(*NagiosHandler).PerfProperty("/"); prop.Unit.Name != "bytes" ||
+		prop.Scale != 1024*1024 {
+		t.Fatalf("unit %s of restored label", prop.Unit)
+	}
+
+	var states = map[int]NagiosState{0: NagiosOK, 2: NagiosCritical, 3: NagiosUnknown, 4: NagiosUnknown,
+		-1: NagiosUnknown}
+	for code, state := range states {
+		if nagiosState(code) != state {
+			t.Fatalf("exit code %d mapped to %s", code, nagiosState(code))
+		}
+	}
+	conf.PollInterval = ""
+	if _, err := NewHandler(conf); err == nil {
+		t.Fatal("accepted nagios handler without poll interval")
+	}
+	conf.PollInterval = "1m"
+	conf.Properties = []PropertyConfig{{Name: "free", Regex: "(\\d+)%"}}
+	if _, err := NewHandler(conf); err == nil {
+		t.Fatal("accepted properties of nagios handler")
+	}
+}
+
+func TestPerfDataLimits(t *testing.T) {
+	conf := HandlerConfig{Name: "Mounts", URL: "/test/nagioslimits", Type: "nagios", PollInterval: "1m",
+		Cmd: "echo 'DISK OK | /=1MB /home=2MB /var=3MB'", MaxLabels: 2, LabelExpiry: "1h"}
+	h, err := NewHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*NagiosHandler)
+	defer os.RemoveAll(timeSeriesPath(handler.Path(), ""))
+	now := time.Now()
+	handler.recordPerfData(handler.Stat(), now)
+	if labels := handler.Labels(); len(labels) != 2 {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+
+	// labels missing for longer than label expiry are removed
+	handler.Command.Args = []string{"echo", "DISK OK"}
+	handler.recordPerfData(handler.Stat(), now.Add(time.Minute))
+	if labels := handler.Labels(); len(labels) != 2 {
+		t.Fatalf("labels %v removed before expiry", labels)
+	}
+	handler.recordPerfData(handler.Stat(), now.Add(2*time.Hour))
+	if labels := handler.Labels(); len(labels) != 0 {
+		t.Fatalf("labels %v not expired", labels)
+	}
+	if files, _ := ioutil.ReadDir(timeSeriesPath(handler.Path(), "perfdata")); len(files) != 0 {
+		t.Fatalf("time series of %d expired labels not removed", len(files))
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright (C) 2016, Heiko Koehler
+// notification channels for alert state changes
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// exec notifiers running longer get killed by default
+const defaultNotifierTimeout = 30 * time.Second
+
+// channel notified about firing and resolved alerts
+type Notifier interface {
+	Name() string
+	Notify(ev AlertEvent) error
+}
+
+var (
+	// map notifier name to notifier
+	NotifierRegistry = make(map[string]Notifier)
+	// functions available in notifier templates
+	notifyFuncs = template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			buf, err := json.Marshal(v)
+			return string(buf), err
+		},
+	}
+)
+
+// register notifier
+func RegisterNotifier(notifier Notifier) {
+	NotifierRegistry[notifier.Name()] = notifier
+}
+
+func NewNotifier(conf NotifierConfig) (Notifier, error) {
+	if conf.Name == "" {
+		return nil, errors.New("Notifier without name")
+	}
+	switch strings.ToLower(conf.Type) {
+	case "webhook":
+		return NewWebhookNotifier(conf)
+	case "exec":
+		return NewExecNotifier(conf)
+	case "smtp":
+		return NewSMTPNotifier(conf)
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown notifier type %s", conf.Type))
+}
+
+// parse template or use default template if not configured
+func parseNotifyTemplate(name, tmplStr, defaultStr string) (*template.Template, error) {
+	if tmplStr == "" {
+		tmplStr = defaultStr
+	}
+	return template.New(name).Funcs(notifyFuncs).Parse(tmplStr)
+}
+
+// render template for alert event
+func renderNotifyTemplate(tmpl *template.Template, ev AlertEvent) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := tmpl.Execute(&buf, ev); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// notify all notifiers listed by name or all registered notifiers if none listed
+// notifications are sent asynchronously to not block the scheduler
+func notify(names []string, ev AlertEvent) {
+	var notifiers = make([]Notifier, 0)
+
+	if len(names) == 0 {
+		for _, notifier := range NotifierRegistry {
+			notifiers = append(notifiers, notifier)
+		}
+	} else {
+		for _, name := range names {
+			if notifier, ok := NotifierRegistry[name]; ok {
+				notifiers = append(notifiers, notifier)
+			}
+		}
+	}
+	for _, notifier := range notifiers {
+		notifier := notifier
+		go func() {
+			if err := notifier.Notify(ev); err != nil {
+				log.Printf("Notifier %s failed for alert %s: %v\n", notifier.Name(), ev.Name, err)
+			}
+		}()
+	}
+}
+
+// POST templated body to HTTP endpoint
+type WebhookNotifier struct {
+	name    string
+	URL     string
+	Headers map[string]string
+	Body    *template.Template
+	Client  *http.Client
+}
+
+func NewWebhookNotifier(conf NotifierConfig) (Notifier, error) {
+	if conf.URL == "" {
+		return nil, errors.New(fmt.Sprintf("Webhook %s without URL", conf.Name))
+	}
+	body, err := parseNotifyTemplate(conf.Name, conf.Body, `{{json .}}`)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookNotifier{name: conf.Name, URL: conf.URL, Headers: conf.Headers,
+		Body: body, Client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (notifier *WebhookNotifier) Name() string {
+	return notifier.name
+}
+
+func (notifier *WebhookNotifier) Notify(ev AlertEvent) error {
+	body, err := renderNotifyTemplate(notifier.Body, ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", notifier.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, val := range notifier.Headers {
+		req.Header.Set(key, val)
+	}
+	resp, err := notifier.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(fmt.Sprintf("Webhook %s returned %s", notifier.URL, resp.Status))
+	}
+	return nil
+}
+
+// run local command with alert fields in environment variables
+// command line is split into arguments honoring quotes like command lines of handlers
+type ExecNotifier struct {
+	name    string
+	CmdLine string
+	Args    []string
+	Timeout time.Duration
+}
+
+func NewExecNotifier(conf NotifierConfig) (Notifier, error) {
+	var timeout = defaultNotifierTimeout
+
+	args, err := SplitCommandLine(conf.Cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New(fmt.Sprintf("Exec notifier %s without command", conf.Name))
+	}
+	if conf.Timeout != "" {
+		if timeout, err = ParseDuration(conf.Timeout); err != nil {
+			return nil, err
+		} else if timeout <= 0 {
+			return nil, errors.New(fmt.Sprintf("Exec notifier %s without timeout", conf.Name))
+		}
+	}
+	return &ExecNotifier{name: conf.Name, CmdLine: conf.Cmd, Args: args, Timeout: timeout}, nil
+}
+
+func (notifier *ExecNotifier) Name() string {
+	return notifier.name
+}
+
+// environment variables describing alert event
+func alertEnv(ev AlertEvent) []string {
+	env := []string{
+		"MAD_ALERT_NAME=" + ev.Name,
+		"MAD_ALERT_STATE=" + ev.State.String(),
+		"MAD_ALERT_HANDLER=" + ev.Handler,
+		"MAD_ALERT_PROPERTY=" + ev.Property,
+		"MAD_ALERT_OP=" + ev.Op,
+		fmt.Sprintf("MAD_ALERT_THRESHOLD=%v", ev.Threshold),
+		fmt.Sprintf("MAD_ALERT_VALUE=%v", ev.Value),
+		"MAD_ALERT_START=" + ev.Start.Format(time.RFC3339),
+	}
+	if !ev.End.IsZero() {
+		env = append(env, "MAD_ALERT_END="+ev.End.Format(time.RFC3339))
+	}
+	return env
+}
+
+// command runs in its own process group, which is killed on timeout including processes
+// started by command
+func (notifier *ExecNotifier) Notify(ev AlertEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifier.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, notifier.Args[0], notifier.Args[1:]...)
+	cmd.Env = append(os.Environ(), alertEnv(ev)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// processes which left process group might keep output open, stop waiting for them
+	cmd.WaitDelay = cmdWaitDelay
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New(fmt.Sprintf("Exec notifier %s timed out after %v: %s",
+			notifier.name, notifier.Timeout, out))
+	} else if err != nil {
+		return errors.New(fmt.Sprintf("%v: %s", err, out))
+	}
+	return nil
+}
+
+// send mail through SMTP relay
+type SMTPNotifier struct {
+	name    string
+	Addr    string
+	From    string
+	To      []string
+	Auth    smtp.Auth
+	Subject *template.Template
+	Body    *template.Template
+}
+
+func NewSMTPNotifier(conf NotifierConfig) (Notifier, error) {
+	var auth smtp.Auth
+	var subject, body *template.Template
+	var err error
+
+	if conf.Addr == "" || conf.From == "" || len(conf.To) == 0 {
+		return nil, errors.New(fmt.Sprintf("SMTP notifier %s requires Addr, From and To", conf.Name))
+	}
+	if subject, err = parseNotifyTemplate(conf.Name, conf.Subject,
+		`[MAD] {{.Name}} {{.State}}`); err != nil {
+		return nil, err
+	}
+	if body, err = parseNotifyTemplate(conf.Name, conf.Body,
+		`Alert {{.Name}} is {{.State}}: {{.Handler}} {{.Property}} = {{.Value}} ({{.Op}} {{.Threshold}})
+Start: {{.Start}}
+{{if not .End.IsZero}}End: {{.End}}
+{{end}}`); err != nil {
+		return nil, err
+	}
+	if conf.User != "" {
+		host := conf.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", conf.User, conf.Password, host)
+	}
+	return &SMTPNotifier{name: conf.Name, Addr: conf.Addr, From: conf.From, To: conf.To,
+		Auth: auth, Subject: subject, Body: body}, nil
+}
+
+func (notifier *SMTPNotifier) Name() string {
+	return notifier.name
+}
+
+func (notifier *SMTPNotifier) Notify(ev AlertEvent) error {
+	var msg bytes.Buffer
+
+	subject, err := renderNotifyTemplate(notifier.Subject, ev)
+	if err != nil {
+		return err
+	}
+	body, err := renderNotifyTemplate(notifier.Body, ev)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(&msg, "From: %s\r\n", notifier.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(notifier.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.Write(bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1))
+	return smtp.SendMail(notifier.Addr, notifier.Auth, notifier.From, notifier.To, msg.Bytes())
+}
@@ -0,0 +1,185 @@
+// Copyright (C) 2016, Heiko Koehler
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEvent = AlertEvent{Name: "LowMemory", Handler: "/os/vmstat", Property: "Free",
+	Op: "<", Threshold: 100, State: AlertFiring, Value: 42, Start: time.Now()}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received = make(chan map[string]interface{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if req.Header.Get("X-Token") != "secret" {
+			t.Errorf("missing header, got %v", req.Header)
+		}
+		received <- body
+	}))
+	defer server.Close()
+
+	notifier, err := NewNotifier(NotifierConfig{Name: "hook", Type: "webhook", URL: server.URL,
+		Headers: map[string]string{"X-Token": "secret"},
+		Body:    `{"text": {{json (printf "%s is %s" .Name .State)}}, "value": {{.Value}}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(testEvent); err != nil {
+		t.Fatal(err)
+	}
+	body := <-received
+	if body["text"] != "LowMemory is firing" || body["value"] != float64(42) {
+		t.Fatalf("unexpected webhook body %v", body)
+	}
+}
+
+func TestExecNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExecNotifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "notify.sh")
+	out := filepath.Join(dir, "out")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$1: $MAD_ALERT_NAME $MAD_ALERT_STATE $MAD_ALERT_VALUE\" > "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewNotifier(NotifierConfig{Name: "script", Type: "exec", Cmd: script + " 'unterminated"}); err == nil {
+		t.Fatal("accepted command line with unterminated quote")
+	}
+	notifier, err := NewNotifier(NotifierConfig{Name: "script", Type: "exec", Cmd: script + " 'low memory'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(testEvent); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(out); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "low memory: LowMemory firing 42\n" {
+		t.Fatalf("unexpected script output %q", buf)
+	}
+
+	// hanging script and its children get killed after timeout
+	hang := filepath.Join(dir, "hang.sh")
+	if err := ioutil.WriteFile(hang, []byte("#!/bin/sh\nsleep 60 &\nsleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewNotifier(NotifierConfig{Name: "hang", Type: "exec", Cmd: hang, Timeout: "0"}); err == nil {
+		t.Fatal("accepted exec notifier without timeout")
+	}
+	notifier, err = NewNotifier(NotifierConfig{Name: "hang", Type: "exec", Cmd: hang, Timeout: "100ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := notifier.Notify(testEvent); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("unexpected error %v of hanging script", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("hanging script ran for %v", d)
+	}
+}
+
+// accept single SMTP session and return received message data
+func fakeSMTPServer(t *testing.T, l net.Listener, data chan string) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+	reply("220 localhost fake SMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "DATA"):
+			var msg []string
+
+			reply("354 go ahead")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				msg = append(msg, line)
+			}
+			data <- strings.Join(msg, "")
+			reply("250 queued")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	var data = make(chan string, 1)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeSMTPServer(t, l, data)
+
+	notifier, err := NewNotifier(NotifierConfig{Name: "mail", Type: "smtp", Addr: l.Addr().String(),
+		From: "mad@localhost", To: []string{"ops@localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(testEvent); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-data
+	if !strings.Contains(msg, "Subject: [MAD] LowMemory firing\r\n") ||
+		!strings.Contains(msg, "/os/vmstat Free = 42") {
+		t.Fatalf("unexpected mail %q", msg)
+	}
+}
+
+func TestNotifierConfig(t *testing.T) {
+	for _, conf := range []NotifierConfig{
+		{Name: "x", Type: "pager"},
+		{Name: "x", Type: "webhook"},
+		{Name: "x", Type: "exec"},
+		{Name: "x", Type: "smtp", Addr: "localhost:25"},
+		{Type: "webhook", URL: "http://localhost"},
+	} {
+		if _, err := NewNotifier(conf); err == nil {
+			t.Fatalf("accepted invalid notifier config %v", conf)
+		}
+	}
+}
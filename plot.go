@@ -1,46 +1,160 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"math"
 	"time"
 
 	"github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
 )
 
-func chartSeries(i int, ts *TimeSeries, prop string, max *float64) chart.Series {
-	xvalues := make([]time.Time, 0)
-	yvalues := make([]float64, 0)
+// data points of single property to be plotted
+type PlotData struct {
+	Name string
+	Data []DataPoint
+	// draw band between min and max of rolled up data points around mean
+	Band bool
+	// unit of values, all data plotted in one chart share same unit
+	Unit Unit
+	// horizontal lines, e.g. thresholds
+	Lines []PlotLine
+}
+
+// horizontal line across chart
+type PlotLine struct {
+	Name  string
+	Value float64
+	// hex color, e.g. "ff0000"
+	Color string
+}
+
+// split data points into segments between gaps
+func segments(data []DataPoint) [][]DataPoint {
+	var segs = make([][]DataPoint, 0)
+	var start = 0
+
+	for i, dp := range data {
+		if dp.IsGap() {
+			if i > start {
+				segs = append(segs, data[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(data) {
+		segs = append(segs, data[start:])
+	}
+	return segs
+}
+
+// chart series of property, i.e. one line per segment between gaps plus min/max band
+// first series names property in legend
+func chartSeries(i int, pd PlotData, max *float64) []chart.Series {
+	style := chart.Style{
+		Show:        true,
+		StrokeColor: chart.GetDefaultColor(i),
+	}
+	bandStyle := chart.Style{
+		Show:            true,
+		StrokeColor:     chart.GetDefaultColor(i).WithAlpha(96),
+		StrokeDashArray: []float64{4, 2},
+	}
+	series := make([]chart.Series, 0)
+	name := pd.Name
+	if pd.Unit.Name != "" {
+		name = fmt.Sprintf("%s (%s)", pd.Name, pd.Unit)
+	}
+
+	for j, seg := range segments(pd.Data) {
+		xvalues := make([]time.Time, 0, len(seg))
+		yvalues := make([]float64, 0, len(seg))
+		minvalues := make([]float64, 0, len(seg))
+		maxvalues := make([]float64, 0, len(seg))
 
-	if data, err := ts.ReadAll(); err == nil {
-		for _, dp := range data {
+		for _, dp := range seg {
 			xvalues = append(xvalues, dp.Tstamp)
 			yvalues = append(yvalues, dp.Val)
+			minvalues = append(minvalues, dp.Min)
+			maxvalues = append(maxvalues, dp.Max)
 			*max = math.Max(*max, dp.Val)
+			if pd.Band {
+				*max = math.Max(*max, dp.Max)
+			}
+		}
+		main := chart.TimeSeries{Style: style, XValues: xvalues, YValues: yvalues}
+		if j == 0 {
+			main.Name = name
+		}
+		series = append(series, main)
+		if pd.Band {
+			series = append(series,
+				chart.TimeSeries{Style: bandStyle, XValues: xvalues, YValues: minvalues},
+				chart.TimeSeries{Style: bandStyle, XValues: xvalues, YValues: maxvalues})
 		}
 	}
-	return chart.TimeSeries{
-		Name: prop,
-		Style: chart.Style{
-			Show:        true,
-			StrokeColor: chart.GetDefaultColor(i),
-		},
-		XValues: xvalues,
-		YValues: yvalues,
+	if len(series) == 0 {
+		series = append(series, chart.TimeSeries{Name: name, Style: style})
 	}
+	return series
 }
 
-func PlotTimeSeries(w io.Writer, ts []*TimeSeries, prop []string) {
+// time span covered by data, zero if there is no data
+func timeSpan(data []PlotData) (first, last time.Time) {
+	for _, pd := range data {
+		if len(pd.Data) == 0 {
+			continue
+		}
+		if first.IsZero() || pd.Data[0].Tstamp.Before(first) {
+			first = pd.Data[0].Tstamp
+		}
+		if pd.Data[len(pd.Data)-1].Tstamp.After(last) {
+			last = pd.Data[len(pd.Data)-1].Tstamp
+		}
+	}
+	return
+}
+
+// pick time format of X axis depending on time span covered by data
+func timeFormatter(data []PlotData) chart.ValueFormatter {
+	first, last := timeSpan(data)
+	if last.Sub(first) > 24*time.Hour {
+		return chart.TimeDateValueFormatter
+	}
+	return chart.TimeMinuteValueFormatter
+}
+
+// plot data points of time series
+func PlotTimeSeries(w io.Writer, data []PlotData) {
 	var max float64 = 1
 	series := make([]chart.Series, 0)
+	// only main series of each property show up in legend
+	legendSeries := make([]chart.Series, 0)
 
-	for i := range ts {
-		series = append(series, chartSeries(i, ts[i], prop[i], &max))
+	for i := range data {
+		tmp := chartSeries(i, data[i], &max)
+		series = append(series, tmp...)
+		legendSeries = append(legendSeries, tmp[0])
+	}
+	// lines span all data
+	if first, last := timeSpan(data); !first.IsZero() {
+		for _, pd := range data {
+			for _, line := range pd.Lines {
+				s := chart.TimeSeries{Name: line.Name,
+					Style: chart.Style{Show: true, StrokeColor: drawing.ColorFromHex(line.Color),
+						StrokeDashArray: []float64{8, 4}},
+					XValues: []time.Time{first, last}, YValues: []float64{line.Value, line.Value}}
+				series = append(series, s)
+				legendSeries = append(legendSeries, s)
+				max = math.Max(max, line.Value)
+			}
+		}
 	}
 	graph := chart.Chart{
 		XAxis: chart.XAxis{
 			Style:          chart.Style{Show: true},
-			ValueFormatter: chart.TimeMinuteValueFormatter,
+			ValueFormatter: timeFormatter(data),
 		},
 		YAxis: chart.YAxis{
 			Style: chart.Style{Show: true},
@@ -48,9 +162,12 @@ func PlotTimeSeries(w io.Writer, ts []*TimeSeries, prop []string) {
 		},
 		Series: series,
 	}
-	if len(ts) > 1 {
+	if len(data) > 0 && data[0].Unit.Format != nil {
+		graph.YAxis.ValueFormatter = data[0].Unit.ValueFormatter
+	}
+	if len(legendSeries) > 1 {
 		graph.Elements = []chart.Renderable{
-			chart.Legend(&graph),
+			chart.Legend(&chart.Chart{Series: legendSeries}),
 		}
 	}
 	graph.Render(chart.SVG, w)
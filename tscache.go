@@ -0,0 +1,99 @@
+// Copyright (C) 2016, Heiko Koehler
+// in-memory cache of most recent data points of time series
+package main
+
+import (
+	"time"
+)
+
+// upper bound of cached data points per time series
+// older data points within retention period are read from disk
+const maxCacheLen = 1 << 16
+
+// ring buffer of most recent data points in chronological order
+type dataPointCache struct {
+	buf []DataPoint
+	// max number of data points
+	capacity int
+	// index of oldest data point once buffer is full
+	start int
+}
+
+func newDataPointCache(capacity int) *dataPointCache {
+	if capacity > maxCacheLen {
+		capacity = maxCacheLen
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &dataPointCache{capacity: capacity}
+}
+
+// number of cached data points
+func (cache *dataPointCache) Len() int {
+	return len(cache.buf)
+}
+
+// i-th oldest data point
+func (cache *dataPointCache) at(i int) DataPoint {
+	return cache.buf[cache.index(i)]
+}
+
+// index of i-th oldest data point in buffer
+func (cache *dataPointCache) index(i int) int {
+	return (cache.start + i) % len(cache.buf)
+}
+
+// add data point at its chronological position, overwriting oldest one if cache is full
+// late data points older than all cached ones are dropped if cache is full
+func (cache *dataPointCache) push(dp DataPoint) {
+	if len(cache.buf) < cache.capacity {
+		cache.buf = append(cache.buf, dp)
+	} else if dp.Tstamp.Before(cache.oldest()) {
+		return
+	} else {
+		cache.buf[cache.start] = dp
+		cache.start = (cache.start + 1) % len(cache.buf)
+	}
+	for i := len(cache.buf) - 1; i > 0 && dp.Tstamp.Before(cache.at(i-1).Tstamp); i-- {
+		j, k := cache.index(i), cache.index(i-1)
+		cache.buf[j], cache.buf[k] = cache.buf[k], cache.buf[j]
+	}
+}
+
+// time stamp of oldest cached data point, zero if cache is empty
+func (cache *dataPointCache) oldest() time.Time {
+	if len(cache.buf) == 0 {
+		return time.Time{}
+	}
+	return cache.at(0).Tstamp
+}
+
+// drop data points older than given time
+func (cache *dataPointCache) trim(from time.Time) {
+	var data = make([]DataPoint, 0, len(cache.buf))
+
+	for i := 0; i < len(cache.buf); i++ {
+		if dp := cache.at(i); !dp.Tstamp.Before(from) {
+			data = append(data, dp)
+		}
+	}
+	cache.buf, cache.start = data, 0
+}
+
+// copy data points between from and to, zero to means no upper bound
+func (cache *dataPointCache) read(from, to time.Time) []DataPoint {
+	var data = make([]DataPoint, 0, len(cache.buf))
+
+	for i := 0; i < len(cache.buf); i++ {
+		dp := cache.at(i)
+		if dp.Tstamp.Before(from) {
+			continue
+		}
+		if !to.IsZero() && dp.Tstamp.After(to) {
+			break
+		}
+		data = append(data, dp)
+	}
+	return data
+}
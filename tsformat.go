@@ -0,0 +1,345 @@
+// Copyright (C) 2016, Heiko Koehler
+// on-disk format of time series log files
+//
+// Each log file starts with a header
+//
+//	magic "MADL" | version uint16 | flags uint16
+//
+// followed by fixed-size records
+//
+//	time stamp int64 (ns since epoch) | value float64 | aggregates float64... | CRC32
+//
+// The upper byte of the flags holds the set of aggregates stored in each record
+// in addition to the value, the CRC32 covers all preceding fields of a record.
+// Sealed logs, which don't get appended to anymore, are compressed instead.
+// The header of compressed logs has flag logFlagCompressed set and is followed by
+//
+//	number of data points uint32 | CRC32 of compressed data uint32 | compressed data
+//
+// where time stamps, values and each aggregate are compressed as separate columns.
+//
+// All integers are little endian.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	logMagic      = "MADL"
+	logVersion    = 1
+	logHeaderSize = 8
+	// size of record without aggregates
+	logRecordSize = 20
+	// data points are compressed
+	logFlagCompressed = 1
+	// size of count and checksum preceding compressed data
+	logCompressedHeaderSize = 8
+)
+
+var (
+	errBadMagic  = errors.New("Not a time series log file")
+	errNotGobLog = errors.New("Not a gob encoded log file")
+)
+
+// header of log file
+type logHeader struct {
+	Version uint16
+	Flags   uint16
+	// aggregates stored per record
+	Aggregates Aggregates
+}
+
+func encodeHeader(hdr logHeader) []byte {
+	buf := make([]byte, logHeaderSize)
+	copy(buf, logMagic)
+	binary.LittleEndian.PutUint16(buf[4:], hdr.Version)
+	binary.LittleEndian.PutUint16(buf[6:], hdr.Flags|uint16(hdr.Aggregates)<<8)
+	return buf
+}
+
+func decodeHeader(buf []byte) (hdr logHeader, err error) {
+	if len(buf) < logHeaderSize || string(buf[:4]) != logMagic {
+		return hdr, errBadMagic
+	}
+	hdr.Version = binary.LittleEndian.Uint16(buf[4:])
+	hdr.Flags = binary.LittleEndian.Uint16(buf[6:]) & 0xff
+	hdr.Aggregates = Aggregates(buf[7])
+	if hdr.Version != logVersion {
+		return hdr, errors.New(fmt.Sprintf("Unsupported log version %d", hdr.Version))
+	}
+	return hdr, nil
+}
+
+// size of record storing given aggregates
+func recordSize(aggs Aggregates) int {
+	return logRecordSize + 8*aggs.Len()
+}
+
+// encode data point into record buffer of recordSize(aggs) bytes
+func encodeRecord(buf []byte, dp DataPoint, aggs Aggregates) {
+	binary.LittleEndian.PutUint64(buf, uint64(dp.Tstamp.UnixNano()))
+	binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(dp.Val))
+	off := 16
+	for _, col := range aggs.columns(dp) {
+		binary.LittleEndian.PutUint64(buf[off:], math.Float64bits(col))
+		off += 8
+	}
+	binary.LittleEndian.PutUint32(buf[off:], crc32.ChecksumIEEE(buf[:off]))
+}
+
+// decode record, returns false if checksum doesn't match
+func decodeRecord(buf []byte, aggs Aggregates) (DataPoint, bool) {
+	var dp DataPoint
+
+	off := len(buf) - 4
+	if crc32.ChecksumIEEE(buf[:off]) != binary.LittleEndian.Uint32(buf[off:]) {
+		return dp, false
+	}
+	dp.Tstamp = time.Unix(0, int64(binary.LittleEndian.Uint64(buf)))
+	dp.Val = math.Float64frombits(binary.LittleEndian.Uint64(buf[8:]))
+	cols := make([]float64, 0, aggs.Len())
+	for i := 16; i < off; i += 8 {
+		cols = append(cols, math.Float64frombits(binary.LittleEndian.Uint64(buf[i:])))
+	}
+	aggs.setColumns(&dp, cols)
+	return dp, true
+}
+
+// decode all records following header
+// returns number of records skipped due to checksum errors
+func decodeRecords(buf []byte, aggs Aggregates) ([]DataPoint, int) {
+	var size = recordSize(aggs)
+	var data = make([]DataPoint, 0, len(buf)/size)
+	var corrupt int
+
+	// ignore partial record at end which might still be written
+	for off := 0; off+size <= len(buf); off += size {
+		if dp, ok := decodeRecord(buf[off:off+size], aggs); ok {
+			data = append(data, dp)
+		} else {
+			corrupt++
+		}
+	}
+	return data, corrupt
+}
+
+// validate header of opened log file and recover uncompressed logs from partial writes
+// header is written to empty files
+// aggregates are only used for writing the header of new logs
+// returns header and number of discarded records
+func openLog(f *os.File, aggs Aggregates) (logHeader, int, error) {
+	var buf = make([]byte, logHeaderSize)
+	var hdr = logHeader{Version: logVersion, Aggregates: aggs}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return hdr, 0, err
+	}
+	if fi.Size() < logHeaderSize {
+		// header itself might be partially written
+		n, _ := f.ReadAt(buf, 0)
+		if n > len(logMagic) {
+			n = len(logMagic)
+		}
+		if !bytes.HasPrefix([]byte(logMagic), buf[:n]) {
+			return hdr, 0, errBadMagic
+		}
+		if err := f.Truncate(0); err != nil {
+			return hdr, 0, err
+		}
+		_, err := f.Write(encodeHeader(hdr))
+		return hdr, 0, err
+	}
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return hdr, 0, err
+	}
+	if hdr, err = decodeHeader(buf); err != nil {
+		return hdr, 0, err
+	}
+	if hdr.Flags&logFlagCompressed != 0 {
+		// compressed logs are written atomically
+		return hdr, 0, nil
+	}
+	discarded, err := recoverLog(f, hdr.Aggregates)
+	if discarded > 0 {
+		log.Printf("Discarded %d partially written records at end of %s\n", discarded, f.Name())
+	}
+	return hdr, discarded, err
+}
+
+// read and decode log file
+// records with checksum errors are skipped
+func readLog(path string) ([]DataPoint, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := decodeHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Flags&logFlagCompressed != 0 {
+		return decodeCompressed(path, buf[logHeaderSize:], hdr.Aggregates)
+	}
+	data, corrupt := decodeRecords(buf[logHeaderSize:], hdr.Aggregates)
+	if corrupt > 0 {
+		log.Printf("Skipped %d corrupt records in %s\n", corrupt, path)
+	}
+	return data, nil
+}
+
+// decode compressed data points following header
+// corrupt data is skipped as a whole
+func decodeCompressed(path string, buf []byte, aggs Aggregates) ([]DataPoint, error) {
+	if len(buf) < logCompressedHeaderSize {
+		log.Printf("Skipped truncated compressed log %s\n", path)
+		return make([]DataPoint, 0), nil
+	}
+	count := binary.LittleEndian.Uint32(buf)
+	payload := buf[logCompressedHeaderSize:]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(buf[4:]) {
+		log.Printf("Skipped %d data points of corrupt compressed log %s\n", count, path)
+		return make([]DataPoint, 0), nil
+	}
+	return decompressDataPoints(payload, int(count), aggs)
+}
+
+// truncate partially written or corrupt records at end of log file
+// returns number of discarded records
+func recoverLog(f *os.File, aggs Aggregates) (int, error) {
+	var discarded int
+	var size = int64(recordSize(aggs))
+	var rec = make([]byte, size)
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := fi.Size()
+	if tail := (end - logHeaderSize) % size; tail != 0 {
+		end -= tail
+		discarded++
+	}
+	for end > logHeaderSize {
+		if _, err := f.ReadAt(rec, end-size); err != nil {
+			return discarded, err
+		}
+		if _, ok := decodeRecord(rec, aggs); ok {
+			break
+		}
+		end -= size
+		discarded++
+	}
+	if discarded > 0 {
+		if err := f.Truncate(end); err != nil {
+			return discarded, err
+		}
+	}
+	return discarded, nil
+}
+
+// read log file written by previous versions as stream of gob encoded data points
+// decoding stops at first corrupt data point
+// returns errNotGobLog if not even the first data point can be decoded
+func readGobLog(path string) ([]DataPoint, error) {
+	var data = make([]DataPoint, 0)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := gob.NewDecoder(f)
+	for {
+		var dp DataPoint
+
+		if err := dec.Decode(&dp); err == nil {
+			data = append(data, NewDataPoint(dp.Tstamp, dp.Val))
+		} else if err == io.EOF {
+			break
+		} else if len(data) == 0 {
+			return nil, errNotGobLog
+		} else {
+			log.Printf("Dropping corrupt tail of %s after %d data points: %v\n", path, len(data), err)
+			break
+		}
+	}
+	return data, nil
+}
+
+// write data points to log file in current format
+func writeLog(path string, data []DataPoint) error {
+	var buf bytes.Buffer
+	var rec = make([]byte, logRecordSize)
+
+	buf.Write(encodeHeader(logHeader{Version: logVersion}))
+	for _, dp := range data {
+		encodeRecord(rec, dp, 0)
+		buf.Write(rec)
+	}
+	return writeFileAtomic(path, buf.Bytes(), true)
+}
+
+// write file to temporary file, optionally sync it and rename it to path
+// without sync file is replaced atomically on process crashes but not on power loss
+func writeFileAtomic(path string, buf []byte, sync bool) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// write data points to compressed log file
+func writeCompressedLog(path string, data []DataPoint, aggs Aggregates) error {
+	var buf bytes.Buffer
+	var tmp = make([]byte, logCompressedHeaderSize)
+
+	payload := compressDataPoints(data, aggs)
+	buf.Write(encodeHeader(logHeader{Version: logVersion, Flags: logFlagCompressed,
+		Aggregates: aggs}))
+	binary.LittleEndian.PutUint32(tmp, uint32(len(data)))
+	binary.LittleEndian.PutUint32(tmp[4:], crc32.ChecksumIEEE(payload))
+	buf.Write(tmp)
+	buf.Write(payload)
+	return writeFileAtomic(path, buf.Bytes(), true)
+}
+
+// rewrite gob encoded log file in current format
+func migrateGobLog(path string) error {
+	data, err := readGobLog(path)
+	if err != nil {
+		return err
+	}
+	if err := writeLog(path, data); err != nil {
+		return err
+	}
+	log.Printf("Migrated %d data points of %s to current log format\n", len(data), path)
+	return nil
+}
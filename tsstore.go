@@ -3,20 +3,44 @@
 package main
 
 import (
+	"bytes"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 	"time"
 )
 
 // single data point
+// data points rolled up from multiple data points carry aggregates of those,
+// Val is their mean
 type DataPoint struct {
-	Tstamp time.Time
-	Val    float64
+	Tstamp        time.Time
+	Val           float64
+	Min, Max, Sum float64
+	Count         uint32
+	Last          float64
+}
+
+// create data point for single sample
+func NewDataPoint(t time.Time, val float64) DataPoint {
+	return DataPoint{Tstamp: t, Val: val, Min: val, Max: val, Sum: val, Count: 1, Last: val}
+}
+
+// create marker of missing sample, e.g. if command failed
+func NewGapDataPoint(t time.Time) DataPoint {
+	return NewDataPoint(t, math.NaN())
+}
+
+// whether data point marks missing sample
+func (dp DataPoint) IsGap() bool {
+	return math.IsNaN(dp.Val)
 }
 
 // time series log file
@@ -26,54 +50,127 @@ type TimeSeriesLog struct {
 	path string
 	// underlying file
 	file *os.File
-	// encoder transmitting on file
-	enc *gob.Encoder
+	// time stamps of first and last data point, zero if log is empty
+	first, last time.Time
+	// number of data points in log
+	count int
+	// number of partially written records discarded on open
+	Discarded int
+	// log is compressed and can't be appended to anymore
+	sealed bool
+	// aggregates stored per data point
+	aggs Aggregates
 }
 
 // Open or create new time series log file
-func NewTimeSeriesLog(path string) (*TimeSeriesLog, error) {
-	if f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666); err != nil {
+// new log files store given aggregates per data point, existing ones keep their aggregates
+// logs written by previous versions are migrated to current format, corrupt logs are moved aside
+// and partially written records at the end are discarded
+func NewTimeSeriesLog(path string, aggs Aggregates) (*TimeSeriesLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
+	if err != nil {
 		return nil, err
-	} else {
-		enc := gob.NewEncoder(f)
-		return &TimeSeriesLog{path, f, enc}, nil
 	}
+	hdr, discarded, err := openLog(f, aggs)
+	if err == errBadMagic {
+		f.Close()
+		if err := migrateGobLog(path); err == errNotGobLog {
+			// keep unknown or corrupt file for inspection instead of overwriting it
+			if err := os.Rename(path, path+".corrupt"); err != nil {
+				return nil, err
+			}
+			log.Printf("Moved corrupt log file %s aside to %s.corrupt\n", path, path)
+		} else if err != nil {
+			return nil, err
+		}
+		return NewTimeSeriesLog(path, aggs)
+	} else if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if hdr.Flags&logFlagCompressed != 0 {
+		f.Close()
+		return &TimeSeriesLog{path: path, sealed: true, aggs: hdr.Aggregates}, nil
+	}
+	return &TimeSeriesLog{path: path, file: f, Discarded: discarded, aggs: hdr.Aggregates}, nil
 }
 
 // Stringer interface
 func (log *TimeSeriesLog) String() string {
-	return fmt.Sprintf("path=%s, file=%d, enc=%v", log.path, log.file.Fd(), log.enc)
+	return fmt.Sprintf("path=%s, sealed=%v", log.path, log.sealed)
+}
+
+// extend time span of log by time stamp
+func (log *TimeSeriesLog) updateSpan(t time.Time) {
+	if log.first.IsZero() || t.Before(log.first) {
+		log.first = t
+	}
+	if log.last.IsZero() || t.After(log.last) {
+		log.last = t
+	}
 }
 
-// append new record to log file
+// check whether log might contain data points between from and to
+func (log *TimeSeriesLog) Overlaps(from, to time.Time) bool {
+	if log.first.IsZero() {
+		return false
+	}
+	return !log.last.Before(from) && !log.first.After(to)
+}
+
+// append new record with current time stamp to log file
 func (log *TimeSeriesLog) Add(val float64) error {
-	return log.enc.Encode(DataPoint{time.Now(), val})
+	return log.AddAt(time.Now(), val)
+}
+
+// append new record with given time stamp to log file
+func (log *TimeSeriesLog) AddAt(t time.Time, val float64) error {
+	return log.Append(NewDataPoint(t, val))
+}
+
+// append data point to log file
+// record is written with single write call to keep torn writes at the end of the file
+func (log *TimeSeriesLog) Append(dp DataPoint) error {
+	var rec = make([]byte, recordSize(log.aggs))
+
+	if log.sealed {
+		return errors.New(fmt.Sprintf("Log %s is sealed", log.path))
+	}
+	encodeRecord(rec, dp, log.aggs)
+	if _, err := log.file.Write(rec); err != nil {
+		return err
+	}
+	log.count++
+	log.updateSpan(dp.Tstamp)
+	return nil
 }
 
 // read and decode whole log file
 func (log *TimeSeriesLog) ReadAll() ([]DataPoint, error) {
-	data := make([]DataPoint, 0)
+	return readLog(log.path)
+}
 
-	if f, err := os.Open(log.path); err != nil {
-		return nil, err
-	} else {
-		defer f.Close()
-		dec := gob.NewDecoder(f)
-
-		for {
-			var dp DataPoint
-
-			if err := dec.Decode(&dp); err == nil {
-				data = append(data, dp)
-			} else if err == io.EOF {
-				break
-			} else {
-				// ignore "extra data in buffer" error
-				//return nil, err
-			}
-		}
+// compress log file, no data points can be added afterwards
+func (log *TimeSeriesLog) Seal() error {
+	if log.sealed {
+		return nil
 	}
-	return data, nil
+	data, err := log.ReadAll()
+	if err != nil {
+		return err
+	}
+	if err := writeCompressedLog(log.path, data, log.aggs); err != nil {
+		return err
+	}
+	log.Close()
+	log.sealed = true
+	return nil
+}
+
+// ID of log within time series as encoded in file name
+func (log *TimeSeriesLog) ID() (id int) {
+	fmt.Sscanf(filepath.Base(log.path), "%d", &id)
+	return
 }
 
 // close log file
@@ -94,38 +191,84 @@ type TimeSeriesLogs []*TimeSeriesLog
 // implement Sorter interface for time series log arrays
 func (logs TimeSeriesLogs) Len() int           { return len(logs) }
 func (logs TimeSeriesLogs) Swap(i, j int)      { logs[i], logs[j] = logs[j], logs[i] }
-func (logs TimeSeriesLogs) Less(i, j int) bool { return logs[i].path < logs[j].path }
+func (logs TimeSeriesLogs) Less(i, j int) bool { return logs[i].ID() < logs[j].ID() }
 
 // time series of data points recorded at same frequency
 // data series is partitioned into multiple log to allow for fast deletion
 // of expired data points
+// single writer and concurrent readers are serialized by read-write lock,
+// readers keep lock while reading logs so that expired logs aren't removed mid-read
 type TimeSeries struct {
+	// protects logs, length and roll-up batch
+	mutex sync.RWMutex
 	// base path of all log files
 	Path string
-	// how many data points to coalesce on roll-up
-	RollUp uint32
-	// min number of data points preserved
-	// this is also the max. number of data points returned by ReadAll
-	Cap uint32
+	// interval between data points
+	Resolution time.Duration
+	// how long data points are kept at least
+	Retention time.Duration
 	// number of data points
 	Len uint32
 	// next log ID
 	NextID int
 	// list of log files in chronological order, i.e. last is current
 	Logs []*TimeSeriesLog
+	// most recent data points
+	cache *dataPointCache
+
+	// aggregates stored per data point
+	Aggregates Aggregates
+
+	// data points may be up to LateWindow older than latest data point
+	// older data points are rejected with ErrLateSample
+	LateWindow time.Duration
+	// time stamp of latest data point
+	latest time.Time
 
 	// lower-level time series
 	LowerLevel *TimeSeries
-	// number of values in current coalescing/roll-up batch
-	// can never be greater than RollUp
+	// open roll-up batches in chronological order
+	// batches are rolled up once their interval plus late window has passed
+	Batches []RollUpBatch
+}
+
+// data point older than late window of time series
+var ErrLateSample = errors.New("Data point older than late window")
+
+// coalescing/roll-up batch of data points within single interval of lower level
+type RollUpBatch struct {
+	// number of values in batch
+	Len int
+	// time stamp of latest data point in batch
+	Latest time.Time
+	// aggregate of all elements in batch
+	// time stamp is start of roll-up interval aligned to resolution of lower level
+	Agg DataPoint
+}
+
+// name of file persisting roll-up batches of time series across restarts
+const batchStateFile = "batch"
+
+// open roll-up batches of time series
+type batchState struct {
+	// single batch written by previous versions
 	BatchLen int
-	// cumulative value of all elements in batch
-	BatchVal float64
+	Batch    DataPoint
+	Batches  []RollUpBatch
+	// time stamp of latest data point when batches were persisted
+	Saved time.Time
 }
 
+// data points sortable by time stamp
+type DataPoints []DataPoint
+
+func (data DataPoints) Len() int           { return len(data) }
+func (data DataPoints) Swap(i, j int)      { data[i], data[j] = data[j], data[i] }
+func (data DataPoints) Less(i, j int) bool { return data[i].Tstamp.Before(data[j].Tstamp) }
+
 // open all exisiting time series log files
-func NewTimeSeries(path string, rollUp uint32,
-	capacity uint32, lowerLevel *TimeSeries) (*TimeSeries, error) {
+func NewTimeSeries(path string, resolution, retention time.Duration,
+	lowerLevel *TimeSeries) (*TimeSeries, error) {
 
 	var count uint32
 	var logs = make([]*TimeSeriesLog, 0)
@@ -139,10 +282,21 @@ func NewTimeSeries(path string, rollUp uint32,
 			for {
 				if fileInfos, err := dir.Readdir(64); err == nil {
 					for _, fi := range fileInfos {
+						var id int
+
+						// skip files other than logs, e.g. temporary files
+						if n, _ := fmt.Sscanf(fi.Name(), "%d", &id); n != 1 ||
+							fi.Name() != fmt.Sprintf("%d", id) {
+							continue
+						}
 						filePath := filepath.Join(path, fi.Name())
-						if log, err := NewTimeSeriesLog(filePath); err == nil {
+						if log, err := NewTimeSeriesLog(filePath, 0); err == nil {
 							if data, err := log.ReadAll(); err == nil {
 								count += uint32(len(data))
+								log.count = len(data)
+								for _, dp := range data {
+									log.updateSpan(dp.Tstamp)
+								}
 							} else {
 								return nil, err
 							}
@@ -168,81 +322,324 @@ func NewTimeSeries(path string, rollUp uint32,
 	}
 
 	sort.Sort(TimeSeriesLogs(logs))
+	// all logs but current one are sealed
+	for i := 0; i+1 < len(logs); i++ {
+		if err := logs[i].Seal(); err != nil {
+			return nil, err
+		}
+	}
 	// retrieve ID of next log file for Add()
 	nextID := 0
 	if len(logs) > 0 {
-		currLog := logs[len(logs)-1]
-		currLogName := filepath.Base(currLog.path)
-		fmt.Sscanf(currLogName, "%d", &nextID)
+		nextID = logs[len(logs)-1].ID() + 1
+	}
+	ts := &TimeSeries{Path: path, Resolution: resolution, Retention: retention,
+		Len: count, Logs: logs, NextID: nextID, LowerLevel: lowerLevel}
+	for _, log := range logs {
+		if log.last.After(ts.latest) {
+			ts.latest = log.last
+		}
 	}
-	return &TimeSeries{Path: path, RollUp: rollUp, Cap: capacity,
-		Len: count, Logs: logs, NextID: nextID, LowerLevel: lowerLevel}, nil
+	ts.cache = newDataPointCache(ts.Cap())
+	if err := ts.fillCache(); err != nil {
+		return nil, err
+	}
+	if lowerLevel != nil {
+		if err := ts.loadBatch(); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
 }
 
-// calculate max size of a log file
-func (ts *TimeSeries) BucketSize() uint32 {
-	return ts.Cap / 2
+// cache most recent data points of logs
+func (ts *TimeSeries) fillCache() error {
+	var data = make([]DataPoint, 0)
+
+	for i := len(ts.Logs) - 1; i >= 0 && len(data) < ts.cache.capacity; i-- {
+		if tmp, err := ts.Logs[i].ReadAll(); err == nil {
+			data = append(tmp, data...)
+		} else {
+			return err
+		}
+	}
+	// late data points might be stored in later logs
+	sort.Stable(DataPoints(data))
+	for _, dp := range data {
+		ts.cache.push(dp)
+	}
+	return nil
+}
+
+// restore roll-up batches persisted by previous instance
+// data points added after batches were persisted are rolled up again
+// missing or corrupt batches are recomputed from data points not rolled up into lower level yet
+func (ts *TimeSeries) loadBatch() error {
+	var state batchState
+
+	f, err := os.Open(filepath.Join(ts.Path, batchStateFile))
+	if os.IsNotExist(err) {
+		return ts.replayBatches(ts.rolledUntil())
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&state); err != nil {
+		log.Printf("Recomputing corrupt roll-up batch of %s: %v\n", ts.Path, err)
+		return ts.replayBatches(ts.rolledUntil())
+	}
+	ts.Batches = state.Batches
+	if state.BatchLen > 0 {
+		batch := RollUpBatch{Len: state.BatchLen, Agg: state.Batch}
+		// batches of count based roll-ups have no interval, continue current one
+		if batch.Agg.Tstamp.IsZero() {
+			batch.Agg.Tstamp = time.Now().Truncate(ts.LowerLevel.Resolution)
+		}
+		ts.Batches = []RollUpBatch{batch}
+	}
+	// batches written by previous versions include all data points
+	if !state.Saved.IsZero() {
+		return ts.replayBatches(state.Saved.Add(time.Nanosecond))
+	}
+	return nil
+}
+
+// end of latest interval rolled up into lower level, zero if none
+func (ts *TimeSeries) rolledUntil() time.Time {
+	if ts.LowerLevel.latest.IsZero() {
+		return time.Time{}
+	}
+	return ts.LowerLevel.latest.Add(ts.LowerLevel.Resolution)
+}
+
+// roll up data points recorded since from again
+func (ts *TimeSeries) replayBatches(from time.Time) error {
+	data, err := ts.readRange(from, time.Time{})
+	if err != nil {
+		return err
+	}
+	for _, dp := range data {
+		if err := ts.rollUp(dp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// persist roll-up batches
+func (ts *TimeSeries) saveBatch() error {
+	var buf bytes.Buffer
+
+	state := batchState{Batches: ts.Batches, Saved: ts.latest}
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(ts.Path, batchStateFile), buf.Bytes(), false)
+}
+
+// max number of data points within retention period
+func (ts *TimeSeries) Cap() int {
+	return int(ts.Retention / ts.Resolution)
+}
+
+// time span covered by single log file
+// two full buckets are sufficient to keep data points of retention period
+func (ts *TimeSeries) BucketSpan() time.Duration {
+	if span := ts.Retention / 2; span > 0 {
+		return span
+	}
+	return 1
 }
 
 // add data point with current time stamp to table
 func (ts *TimeSeries) Add(val float64) error {
+	return ts.AddAt(time.Now(), val)
+}
+
+// add data point with given time stamp to table
+func (ts *TimeSeries) AddAt(t time.Time, val float64) error {
+	return ts.add(NewDataPoint(t, val))
+}
+
+// remove logs whose data points are all older than retention period
+// current log is never removed
+func (ts *TimeSeries) expire(now time.Time) {
+	cutoff := now.Add(-ts.Retention)
+	for len(ts.Logs) > 1 && ts.Logs[0].last.Before(cutoff) {
+		ts.Len -= uint32(ts.Logs[0].count)
+		ts.Logs[0].Close()
+		ts.Logs[0].Remove()
+		ts.Logs = ts.Logs[1:]
+	}
+	// cached data points of removed logs are expired as well
+	ts.cache.trim(cutoff)
+}
+
+// append data point and roll it up into lower level
+func (ts *TimeSeries) add(dp DataPoint) error {
 	var currLog *TimeSeriesLog
 
-	// create new bucket if either bucket is full or no bucket exists yet
-	if ts.Len%ts.BucketSize() == 0 {
-		// bucket size is ts.Cap divided by 2 hence 2 full buckets
-		// are suffient to keep ts.Cap data points
-		if len(ts.Logs) > 2 {
-			oldLogs := ts.Logs[0 : len(ts.Logs)-2]
-			ts.Logs = ts.Logs[len(ts.Logs)-2:]
-			for _, oldLog := range oldLogs {
-				oldLog.Remove()
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if !ts.latest.IsZero() && dp.Tstamp.Before(ts.latest.Add(-ts.LateWindow)) {
+		return ErrLateSample
+	}
+	if len(ts.Logs) > 0 {
+		currLog = ts.Logs[len(ts.Logs)-1]
+	}
+	// create new bucket if either bucket spans more than BucketSpan() or no bucket exists yet
+	if currLog == nil || currLog.sealed ||
+		(!currLog.first.IsZero() && !dp.Tstamp.Before(currLog.first.Add(ts.BucketSpan()))) {
+		// seal current bucket
+		if currLog != nil {
+			if err := currLog.Seal(); err != nil {
+				return err
 			}
 		}
 		path := filepath.Join(ts.Path, fmt.Sprintf("%d", ts.NextID))
-		if log, err := NewTimeSeriesLog(path); err == nil {
+		if log, err := NewTimeSeriesLog(path, ts.Aggregates); err == nil {
 			ts.Logs = append(ts.Logs, log)
 			currLog = log
 			ts.NextID++
 		} else {
 			return err
 		}
-	} else {
-		currLog = ts.Logs[len(ts.Logs)-1]
+		ts.expire(dp.Tstamp)
+	}
+	if err := currLog.Append(dp); err != nil {
+		return err
 	}
-	currLog.Add(val)
 	ts.Len++
-
-	// coalesce current batch into single value for lower TS level with lower granularity
+	ts.cache.push(ts.Aggregates.stored(dp))
+	if dp.Tstamp.After(ts.latest) {
+		ts.latest = dp.Tstamp
+	}
 	if ts.LowerLevel != nil {
-		ts.BatchVal += float64(val)
-		ts.BatchLen++
-		if ts.BatchLen == int(ts.RollUp) {
-			err := ts.LowerLevel.Add(ts.BatchVal / float64(ts.BatchLen))
-			ts.BatchVal = 0
-			ts.BatchLen = 0
+		return ts.rollUp(dp)
+	}
+	return nil
+}
+
+// coalesce data points within same interval of lower level into single data point
+// intervals are aligned to wall clock, e.g. full minutes or hours
+// batches are rolled up once no more data points of their interval are accepted
+func (ts *TimeSeries) rollUp(dp DataPoint) error {
+	var i int
+
+	start := dp.Tstamp.Truncate(ts.LowerLevel.Resolution)
+	for i < len(ts.Batches) && ts.Batches[i].Agg.Tstamp.Before(start) {
+		i++
+	}
+	if i == len(ts.Batches) || !ts.Batches[i].Agg.Tstamp.Equal(start) {
+		ts.Batches = append(ts.Batches, RollUpBatch{})
+		copy(ts.Batches[i+1:], ts.Batches[i:])
+		ts.Batches[i] = RollUpBatch{Agg: DataPoint{Tstamp: start}}
+	}
+	batch := &ts.Batches[i]
+	last := batch.Agg.Last
+	batch.Agg.Merge(dp)
+	if dp.Tstamp.Before(batch.Latest) {
+		// late data point isn't last one of interval
+		batch.Agg.Last = last
+	} else if !dp.IsGap() {
+		batch.Latest = dp.Tstamp
+	}
+	batch.Len++
+
+	var flushed bool
+	for len(ts.Batches) > 0 {
+		rolled := ts.Batches[0].Agg
+		if ts.latest.Before(rolled.Tstamp.Add(ts.LowerLevel.Resolution + ts.LateWindow)) {
+			break
+		}
+		ts.Batches = ts.Batches[1:]
+		// interval without any samples remains gap
+		if rolled.Count == 0 {
+			rolled = NewGapDataPoint(rolled.Tstamp)
+		}
+		if err := ts.LowerLevel.add(rolled); err != nil {
 			return err
 		}
+		flushed = true
+	}
+	// batches are persisted at roll-up boundaries and on close only
+	if flushed {
+		return ts.saveBatch()
 	}
 	return nil
 }
 
-// read up to "Cap" data points
+// read all data points, this might include data points older than retention period
 func (ts *TimeSeries) ReadAll() ([]DataPoint, error) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	return ts.readRange(time.Time{}, time.Time{})
+}
+
+// read data points recorded between from and to
+// logs outside of time window are skipped without being read
+func (ts *TimeSeries) ReadRange(from, to time.Time) ([]DataPoint, error) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	return ts.readRange(from, to)
+}
+
+// read data points between from and to, zero to means no upper bound
+// only data points older than cached ones are read from logs
+func (ts *TimeSeries) readRange(from, to time.Time) ([]DataPoint, error) {
 	var data = make([]DataPoint, 0)
+	var cached = ts.cache.oldest()
 
 	for _, log := range ts.Logs {
+		if ts.cache.Len() > 0 && !from.Before(cached) {
+			break
+		}
+		if log.first.IsZero() || log.last.Before(from) || (!to.IsZero() && log.first.After(to)) {
+			continue
+		}
+		if ts.cache.Len() > 0 && !log.first.Before(cached) {
+			continue
+		}
 		if tmp, err := log.ReadAll(); err == nil {
-			data = append(data, tmp...)
+			for _, dp := range tmp {
+				if ts.cache.Len() > 0 && !dp.Tstamp.Before(cached) {
+					continue
+				}
+				if !dp.Tstamp.Before(from) && (to.IsZero() || !dp.Tstamp.After(to)) {
+					data = append(data, dp)
+				}
+			}
 		} else {
 			return nil, err
 		}
 	}
-	return data, nil
+	// late data points are appended to current log
+	sort.Stable(DataPoints(data))
+	return append(data, ts.cache.read(from, to)...), nil
+}
+
+// time stamp of oldest data point, zero if time series is empty
+func (ts *TimeSeries) Oldest() time.Time {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	for _, log := range ts.Logs {
+		if !log.first.IsZero() {
+			return log.first
+		}
+	}
+	return time.Time{}
 }
 
 // close table including all log files
 func (ts *TimeSeries) Close() {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.LowerLevel != nil {
+		if err := ts.saveBatch(); err != nil {
+			log.Printf("Failed to persist roll-up batch of %s: %v\n", ts.Path, err)
+		}
+	}
 	for _, log := range ts.Logs {
 		log.Close()
 	}
@@ -250,9 +647,14 @@ func (ts *TimeSeries) Close() {
 
 // remove table including all log files
 func (ts *TimeSeries) Remove() {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
 	for _, log := range ts.Logs {
+		log.Close()
 		log.Remove()
 	}
+	ts.cache = newDataPointCache(ts.Cap())
+	os.Remove(filepath.Join(ts.Path, batchStateFile))
 }
 
 // time series table
@@ -264,10 +666,31 @@ type TimeSeriesTable struct {
 }
 
 type TimeSeriesProps struct {
-	// number of data points to coalesce into single data point on roll-up
-	RollUp uint32
-	// total number of data point to be kept in time series
-	Capacity uint32
+	// interval between data points
+	// the top level stores data points as they are recorded, its resolution is nominal
+	Resolution time.Duration
+	// how long data points are kept
+	Retention time.Duration
+	// aggregates stored per data point in addition to mean
+	Aggregates Aggregates
+}
+
+// check that levels are ordered from finest to coarsest resolution
+func ValidateTimeSeriesProps(tsProps []TimeSeriesProps) error {
+	if len(tsProps) == 0 {
+		return errors.New("No time series specified on any level")
+	}
+	for i, prop := range tsProps {
+		if prop.Resolution <= 0 || prop.Retention < prop.Resolution {
+			return errors.New(fmt.Sprintf("Invalid resolution %v or retention %v on level %d",
+				prop.Resolution, prop.Retention, i))
+		}
+		if i > 0 && prop.Resolution <= tsProps[i-1].Resolution {
+			return errors.New(fmt.Sprintf("Resolution %v of level %d not coarser than %v",
+				prop.Resolution, i, tsProps[i-1].Resolution))
+		}
+	}
+	return nil
 }
 
 // create local time series with different levels of granularities as specified in tsProps
@@ -275,15 +698,16 @@ func NewTimeSeriesTable(path string, tsProps []TimeSeriesProps) (*TimeSeriesTabl
 	var tsList = make([]*TimeSeries, 0)
 	var prevTS *TimeSeries
 
-	if len(tsProps) == 0 {
-		return nil, errors.New("No time series specified on any level")
+	if err := ValidateTimeSeriesProps(tsProps); err != nil {
+		return nil, err
 	}
 
 	fmt.Println(path)
 	for id := len(tsProps) - 1; id >= 0; id-- {
 		prop := tsProps[id]
 		tsPath := filepath.Join(path, fmt.Sprintf("%d", id))
-		if ts, err := NewTimeSeries(tsPath, prop.RollUp, prop.Capacity, prevTS); err == nil {
+		if ts, err := NewTimeSeries(tsPath, prop.Resolution, prop.Retention, prevTS); err == nil {
+			ts.Aggregates = prop.Aggregates
 			tsList = append(tsList, ts)
 			prevTS = ts
 		} else {
@@ -306,6 +730,66 @@ func (tbl *TimeSeriesTable) Add(val float64) error {
 	return ts.Add(val)
 }
 
+// add data point with given time stamp to top level
+// data points older than late window of top level are rejected with ErrLateSample
+func (tbl *TimeSeriesTable) AddAt(t time.Time, val float64) error {
+	return tbl.TopLevel().AddAt(t, val)
+}
+
+// pick finest level still covering data points since from
+// if no level reaches back far enough, pick level with oldest data
+func (tbl *TimeSeriesTable) LevelFor(from time.Time) *TimeSeries {
+	var best *TimeSeries
+	var bestOldest time.Time
+
+	for id := len(tbl.TS) - 1; id >= 0; id-- {
+		ts := tbl.TS[id]
+		oldest := ts.Oldest()
+		if oldest.IsZero() {
+			continue
+		}
+		if !oldest.After(from) {
+			return ts
+		}
+		if best == nil || oldest.Before(bestOldest) {
+			best, bestOldest = ts, oldest
+		}
+	}
+	if best == nil {
+		return tbl.TopLevel()
+	}
+	return best
+}
+
+// read data points between from and to from finest level covering time range
+func (tbl *TimeSeriesTable) Query(from, to time.Time) ([]DataPoint, error) {
+	return tbl.LevelFor(from).ReadRange(from, to)
+}
+
+// whether both tables have levels with same resolution and retention
+func (tbl *TimeSeriesTable) SameLevels(other *TimeSeriesTable) bool {
+	if len(tbl.TS) != len(other.TS) {
+		return false
+	}
+	for i, ts := range tbl.TS {
+		if ts.Resolution != other.TS[i].Resolution || ts.Retention != other.TS[i].Retention {
+			return false
+		}
+	}
+	return true
+}
+
+// properties of levels from finest to coarsest level
+func (tbl *TimeSeriesTable) Props() []TimeSeriesProps {
+	var tsProps = make([]TimeSeriesProps, 0, len(tbl.TS))
+
+	for id := len(tbl.TS) - 1; id >= 0; id-- {
+		ts := tbl.TS[id]
+		tsProps = append(tsProps, TimeSeriesProps{ts.Resolution, ts.Retention, ts.Aggregates})
+	}
+	return tsProps
+}
+
 // close all time series logs
 func (tbl *TimeSeriesTable) Close() {
 	for _, ts := range tbl.TS {
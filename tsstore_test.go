@@ -3,16 +3,21 @@
 package main
 
 import (
+	"bytes"
 	"encoding/gob"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestMarshalling(t *testing.T) {
 	var dp2 DataPoint
-	var dp = DataPoint{time.Now(), 0xdeadbeef}
+	var dp = NewDataPoint(time.Now(), 0xdeadbeef)
 	var path = filepath.Join(os.TempDir(), "TestMarshalling.gob")
 
 	defer os.Remove(path)
@@ -31,7 +36,7 @@ func TestMarshalling(t *testing.T) {
 		defer file.Close()
 		dec := gob.NewDecoder(file)
 		dec.Decode(&dp2)
-		if dp != dp2 {
+		if !dp.Tstamp.Equal(dp2.Tstamp) || dp.Val != dp2.Val {
 			t.Fatal(fmt.Sprintf("encoded and decoded data points don't match: %v vs %v", dp, dp2))
 		}
 	}
@@ -42,7 +47,7 @@ func TestTimeSeriesLog(t *testing.T) {
 	path := filepath.Join(dir, "timeSeriesTest.log")
 
 	t.Logf("Created new time series log at: %s\n", path)
-	log, err := NewTimeSeriesLog(path)
+	log, err := NewTimeSeriesLog(path, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -89,18 +94,33 @@ func validateTimeSeries(t *testing.T, ts *TimeSeries, expLen int, expIncr float6
 	}
 }
 
+// add n data points with increasing values at one second intervals
+func addSeries(t *testing.T, ts *TimeSeries, start time.Time, from, to int) {
+	for i := from; i < to; i++ {
+		dp := NewDataPoint(start.Add(time.Duration(i)*time.Second), float64(i))
+		if err := ts.add(dp); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// aligned to full minutes and hours
+var testStart = time.Unix(1000000000, 0)
+
 func TestTimeSeries(t *testing.T) {
 	path := filepath.Join(os.TempDir(), "TestTimeSeries")
+	os.RemoveAll(path)
 
-	if ts, err := NewTimeSeries(path, 10, 100, nil); err == nil {
-		defer ts.Close()
+	if ts, err := NewTimeSeries(path, time.Second, 100*time.Second, nil); err == nil {
+		defer ts.Remove()
 
-		for i := 0; i < 200; i++ {
-			if err := ts.Add(float64(i)); err != nil {
-				t.Fatal(err)
-			}
-		}
+		addSeries(t, ts, testStart, 0, 200)
 		validateTimeSeries(t, ts, 100, 1)
+		// expired buckets are removed
+		if data, _ := ts.ReadAll(); len(data) > ts.Cap()+int(ts.BucketSpan()/time.Second) ||
+			int(ts.Len) != len(data) {
+			t.Fatalf("kept %d of %d data points", len(data), ts.Len)
+		}
 	} else {
 		t.Fatal(err)
 	}
@@ -112,49 +132,565 @@ func TestCoalescing(t *testing.T) {
 
 	defer func() {
 		if ts1 != nil {
-			ts1.Close()
+			ts1.Remove()
 		}
 		if ts2 != nil {
-			ts2.Close()
+			ts2.Remove()
 		}
 	}()
 
 	tsPath1 := filepath.Join(os.TempDir(), "TestCoalescing", "ts1")
 	tsPath2 := filepath.Join(os.TempDir(), "TestCoalescing", "ts2")
+	os.RemoveAll(filepath.Dir(tsPath1))
 
-	if ts2, err = NewTimeSeries(tsPath2, 10, 100, nil); err != nil {
+	if ts2, err = NewTimeSeries(tsPath2, 10*time.Second, 1000*time.Second, nil); err != nil {
 		t.Fatal(err)
 	}
 	// use ts2 as lower level for ts1
-	if ts1, err = NewTimeSeries(tsPath1, 10, 100, ts2); err != nil {
+	if ts1, err = NewTimeSeries(tsPath1, time.Second, 100*time.Second, ts2); err != nil {
 		t.Fatal(err)
 	}
 
-	for i := 0; i < 200; i++ {
-		if err := ts1.Add(float64(i)); err != nil {
-			t.Fatal(err)
-		}
-	}
-
+	addSeries(t, ts1, testStart, 0, 200)
 	validateTimeSeries(t, ts1, 100, 1)
-	validateTimeSeries(t, ts2, 10, 10)
+	validateTimeSeries(t, ts2, 19, 10)
+	// rolled up data points are stamped with start of their interval
+	if data, _ := ts2.ReadAll(); !data[1].Tstamp.Equal(testStart.Add(10 * time.Second)) {
+		t.Fatalf("rolled up data point at %v", data[1].Tstamp)
+	}
 }
 
 func TestTimeSeriesTable(t *testing.T) {
 	path := filepath.Join(os.TempDir(), "TestTimeSeriesTable")
-	// keep 100 data points on each level, roll up every 10 data points
-	if tbl, err := NewTimeSeriesTable(path, []TimeSeriesProps{{10, 100}, {10, 100}, {10, 100}}); err == nil {
+	os.RemoveAll(path)
+	// keep 100 data points on each level, roll up into 10 and 100 second intervals
+	if tbl, err := NewTimeSeriesTable(path, []TimeSeriesProps{
+		{time.Second, 100 * time.Second, 0},
+		{10 * time.Second, 1000 * time.Second, 0},
+		{100 * time.Second, 10000 * time.Second, 0}}); err == nil {
 		defer tbl.Remove()
 
-		for i := 0; i < 2000; i++ {
-			if err := tbl.Add(float64(i)); err != nil {
+		addSeries(t, tbl.TopLevel(), testStart, 0, 2000)
+		validateTimeSeries(t, tbl.TS[2], 100, 1)
+		validateTimeSeries(t, tbl.TS[1], 100, 10)
+		validateTimeSeries(t, tbl.TS[0], 19, 100)
+	} else {
+		t.Fatal(err)
+	}
+
+	// levels must get coarser
+	if _, err := NewTimeSeriesTable(path, []TimeSeriesProps{
+		{time.Minute, time.Hour, 0}, {time.Second, time.Hour, 0}}); err == nil {
+		t.Fatal("accepted finer resolution on lower level")
+	}
+	if _, err := NewTimeSeriesTable(path, []TimeSeriesProps{{time.Minute, time.Second, 0}}); err == nil {
+		t.Fatal("accepted retention shorter than resolution")
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestReadRange")
+	os.RemoveAll(path)
+
+	if ts, err := NewTimeSeries(path, time.Second, 100*time.Second, nil); err == nil {
+		defer ts.Remove()
+
+		addSeries(t, ts, testStart, 0, 100)
+		for i := 0; i < 4; i++ {
+			from := testStart.Add(time.Duration(i*25) * time.Second)
+			data, err := ts.ReadRange(from, from.Add(25*time.Second-1))
+			if err != nil {
 				t.Fatal(err)
 			}
+			if len(data) != 25 || data[0].Val != float64(i*25) {
+				t.Fatalf("read %d data points in range %d", len(data), i)
+			}
 		}
-		validateTimeSeries(t, tbl.TS[2], 100, 1)
-		validateTimeSeries(t, tbl.TS[1], 100, 10)
-		validateTimeSeries(t, tbl.TS[0], 20, 100)
+		if data, err := ts.ReadRange(testStart.Add(100*time.Second), time.Now()); err != nil {
+			t.Fatal(err)
+		} else if len(data) != 0 {
+			t.Fatalf("read %d data points after last data point", len(data))
+		}
+	} else {
+		t.Fatal(err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestQuery")
+	os.RemoveAll(path)
+
+	if tbl, err := NewTimeSeriesTable(path, []TimeSeriesProps{
+		{time.Second, 20 * time.Second, 0}, {10 * time.Second, 1000 * time.Second, 0}}); err == nil {
+		defer tbl.Remove()
+
+		addSeries(t, tbl.TopLevel(), testStart, 0, 200)
+		// only lower level still covers all data points
+		if ts := tbl.LevelFor(testStart); ts != tbl.TS[0] {
+			t.Fatalf("picked level %s for start time", ts.Path)
+		}
+		if data, err := tbl.Query(testStart, testStart.Add(200*time.Second)); err != nil {
+			t.Fatal(err)
+		} else if len(data) != 19 {
+			t.Fatalf("read %d data points from lower level", len(data))
+		}
+		// top level covers recent data points
+		recent := tbl.TopLevel().Oldest()
+		if ts := tbl.LevelFor(recent); ts != tbl.TopLevel() {
+			t.Fatalf("picked level %s for recent time", ts.Path)
+		}
+	} else {
+		t.Fatal(err)
+	}
+}
+
+func TestLogRecovery(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestLogRecovery.log")
+	os.Remove(path)
+	defer os.Remove(path)
+
+	log, err := NewTimeSeriesLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := log.Add(float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Close()
+
+	// simulate torn write of record followed by corrupt full record
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, logRecordSize+7))
+	f.Close()
+
+	if log, err = NewTimeSeriesLog(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if log.Discarded != 2 {
+		t.Fatalf("discarded %d records instead of 2", log.Discarded)
+	}
+	if err := log.Add(10); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := log.ReadAll(); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 11 || data[10].Val != 10 {
+		t.Fatalf("read %d data points after recovery", len(data))
+	}
+}
+
+func TestGobLogMigration(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestGobLogMigration.log")
+	os.Remove(path)
+	defer os.Remove(path)
+
+	// write log in old gob format
+	if file, err := os.Create(path); err != nil {
+		t.Fatal(err)
 	} else {
+		enc := gob.NewEncoder(file)
+		for i := 0; i < 100; i++ {
+			enc.Encode(DataPoint{Tstamp: time.Now(), Val: float64(i)})
+		}
+		file.Close()
+	}
+
+	log, err := NewTimeSeriesLog(path, 0)
+	if err != nil {
 		t.Fatal(err)
 	}
+	defer log.Close()
+	log.Add(100)
+	if data, err := log.ReadAll(); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 101 {
+		t.Fatalf("read %d data points after migration", len(data))
+	} else {
+		for i, dp := range data {
+			if dp.Val != float64(i) {
+				t.Fatalf("Expected val = %d got %f\n", i, dp.Val)
+			}
+		}
+	}
+}
+
+func TestCorruptLogHeader(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestCorruptLogHeader.log")
+	os.Remove(path)
+	defer os.Remove(path)
+	defer os.Remove(path + ".corrupt")
+
+	// log in current format whose magic got corrupted isn't a gob log either
+	var buf bytes.Buffer
+	var rec = make([]byte, logRecordSize)
+	buf.Write(encodeHeader(logHeader{Version: logVersion}))
+	encodeRecord(rec, NewDataPoint(time.Now(), 42), 0)
+	buf.Write(rec)
+	corrupt := buf.Bytes()
+	copy(corrupt, "XXXX")
+	if err := ioutil.WriteFile(path, corrupt, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := NewTimeSeriesLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if data, err := log.ReadAll(); err != nil || len(data) != 0 {
+		t.Fatalf("unexpected data points %+v of new log: %v", data, err)
+	}
+	if buf, err := ioutil.ReadFile(path + ".corrupt"); err != nil || !bytes.Equal(buf, corrupt) {
+		t.Fatalf("corrupt log not kept: %v", err)
+	}
+}
+
+func TestRollUpAggregates(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestRollUpAggregates")
+	os.RemoveAll(path)
+
+	aggs, err := ParseAggregates([]string{"min", "max", "mean", "sum", "count", "last"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := NewTimeSeriesTable(path, []TimeSeriesProps{
+		{time.Second, 100 * time.Second, 0},
+		{10 * time.Second, 1000 * time.Second, aggs},
+		{100 * time.Second, 10000 * time.Second, AggMax}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Remove()
+	addSeries(t, tbl.TopLevel(), testStart, 0, 1000)
+
+	data, err := tbl.TS[1].ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, dp := range data[len(data)-10:] {
+		start := float64(890 + i*10)
+		if dp.Min != start || dp.Max != start+9 || dp.Last != start+9 ||
+			dp.Count != 10 || dp.Sum != 10*start+45 || dp.Val != start+4.5 {
+			t.Fatalf("unexpected aggregates %+v", dp)
+		}
+	}
+	// lowest level only stores max, other aggregates are derived from mean
+	data, err = tbl.TS[0].ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 9 || data[8].Max != 899 || data[8].Val != 849.5 || data[8].Min != 849.5 {
+		t.Fatalf("unexpected aggregates %+v", data[len(data)-1])
+	}
+
+	// percentiles can't be rolled up
+	for _, name := range []string{"median", "p95"} {
+		if _, err := ParseAggregates([]string{name}); err == nil {
+			t.Fatalf("accepted unknown aggregate %s", name)
+		}
+	}
+}
+
+func TestBatchPersistence(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestBatchPersistence")
+	os.RemoveAll(path)
+	props := []TimeSeriesProps{{time.Second, 100 * time.Second, 0},
+		{10 * time.Second, 1000 * time.Second, AggMin | AggMax}}
+
+	tbl, err := NewTimeSeriesTable(path, props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addSeries(t, tbl.TopLevel(), testStart, 0, 15)
+	tbl.Close()
+
+	// batch of 5 data points survives restart
+	if tbl, err = NewTimeSeriesTable(path, props); err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Remove()
+	addSeries(t, tbl.TopLevel(), testStart, 15, 25)
+	if data, err := tbl.TS[0].ReadAll(); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 2 || data[1].Val != 14.5 || data[1].Min != 10 || data[1].Max != 19 {
+		t.Fatalf("unexpected roll-up after restart %+v", data)
+	}
+}
+
+func TestBatchRecovery(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestBatchRecovery")
+	os.RemoveAll(path)
+	props := []TimeSeriesProps{{time.Second, 100 * time.Second, 0},
+		{10 * time.Second, 1000 * time.Second, AggMin | AggMax}}
+	batchPath := filepath.Join(path, "0", batchStateFile)
+
+	tbl, err := NewTimeSeriesTable(path, props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Remove()
+	addSeries(t, tbl.TopLevel(), testStart, 0, 12)
+	// batches are persisted at roll-up boundaries only
+	buf, err := ioutil.ReadFile(batchPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addSeries(t, tbl.TopLevel(), testStart, 12, 15)
+	if tmp, _ := ioutil.ReadFile(batchPath); !bytes.Equal(tmp, buf) {
+		t.Fatal("batch persisted within roll-up interval")
+	}
+
+	// data points added after batch was persisted are rolled up again after crash
+	for _, ts := range tbl.TS {
+		for _, log := range ts.Logs {
+			log.Close()
+		}
+	}
+	if tbl, err = NewTimeSeriesTable(path, props); err != nil {
+		t.Fatal(err)
+	}
+	addSeries(t, tbl.TopLevel(), testStart, 15, 25)
+	tbl.Close()
+	if data, err := tbl.TS[0].ReadAll(); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 2 || data[1].Val != 14.5 || data[1].Min != 10 || data[1].Max != 19 {
+		t.Fatalf("unexpected roll-up after crash %+v", data)
+	}
+
+	// corrupt batch is recomputed from data points not rolled up yet
+	if err := ioutil.WriteFile(batchPath, []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if tbl, err = NewTimeSeriesTable(path, props); err != nil {
+		t.Fatal(err)
+	}
+	addSeries(t, tbl.TopLevel(), testStart, 25, 35)
+	if data, err := tbl.TS[0].ReadAll(); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 3 || data[2].Val != 24.5 || data[2].Min != 20 || data[2].Max != 29 {
+		t.Fatalf("unexpected roll-up of corrupt batch %+v", data)
+	}
+}
+
+// run with -race to detect unsynchronized access
+func TestConcurrentAccess(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestConcurrentAccess")
+	os.RemoveAll(path)
+
+	tbl, err := NewTimeSeriesTable(path, []TimeSeriesProps{
+		{time.Second, 20 * time.Second, 0},
+		{10 * time.Second, 100 * time.Second, AggMin | AggMax}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Remove()
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			dp := NewDataPoint(testStart.Add(time.Duration(i)*time.Second), float64(i))
+			if err := tbl.TopLevel().add(dp); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	var readers sync.WaitGroup
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; i < 50; i++ {
+				for _, ts := range tbl.TS {
+					data, err := ts.ReadAll()
+					if err != nil {
+						errs <- err
+						return
+					}
+					// buckets must never be read partially expired
+					for j := 1; j < len(data); j++ {
+						if data[j].Val <= data[j-1].Val {
+							errs <- fmt.Errorf("data points out of order in %s", ts.Path)
+							return
+						}
+					}
+				}
+				from := tbl.TopLevel().Oldest()
+				if _, err := tbl.Query(from, from.Add(time.Minute)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	validateTimeSeries(t, tbl.TopLevel(), 20, 1)
+	validateTimeSeries(t, tbl.TS[0], 10, 10)
+}
+
+func TestCache(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestCache")
+	os.RemoveAll(path)
+
+	ts, err := NewTimeSeries(path, time.Second, 100*time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Remove()
+	addSeries(t, ts, testStart, 0, 230)
+	if ts.cache.Len() != ts.Cap() {
+		t.Fatalf("cached %d data points", ts.cache.Len())
+	}
+	// data points older than cached ones are read from disk
+	data, err := ts.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != int(ts.Len) || len(data) <= ts.Cap() {
+		t.Fatalf("read %d of %d data points", len(data), ts.Len)
+	}
+	validateTimeSeries(t, ts, len(data), 1)
+	ts.Close()
+
+	// cache is filled on open
+	if ts, err = NewTimeSeries(path, time.Second, 100*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ts.cache.Len() != ts.Cap() || !ts.cache.oldest().Equal(testStart.Add(130*time.Second)) {
+		t.Fatalf("cached %d data points since %v", ts.cache.Len(), ts.cache.oldest())
+	}
+	// recent data points are served without reading logs
+	for _, log := range ts.Logs {
+		os.Remove(log.path)
+	}
+	if data, err := ts.ReadRange(testStart.Add(200*time.Second), testStart.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 30 || data[0].Val != 200 {
+		t.Fatalf("read %d recent data points", len(data))
+	}
+}
+
+func TestLateSamples(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestLateSamples")
+	os.RemoveAll(path)
+	props := []TimeSeriesProps{{time.Second, 100 * time.Second, 0},
+		{10 * time.Second, 1000 * time.Second, AggCount | AggLast}}
+	at := func(i int) time.Time { return testStart.Add(time.Duration(i) * time.Second) }
+
+	tbl, err := NewTimeSeriesTable(path, props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := tbl.AddAt(at(i), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// out-of-order samples are rejected by default
+	if err := tbl.AddAt(at(5), 5); err != ErrLateSample {
+		t.Fatalf("accepted late sample: %v", err)
+	}
+	tbl.Remove()
+
+	if tbl, err = NewTimeSeriesTable(path, props); err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Remove()
+	tbl.TopLevel().LateWindow = 15 * time.Second
+	for i := 0; i < 30; i++ {
+		if i == 12 || i == 25 {
+			continue
+		}
+		if err := tbl.AddAt(at(i), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tbl.AddAt(at(12), 12); err != ErrLateSample {
+		t.Fatalf("accepted sample older than late window: %v", err)
+	}
+	if err := tbl.AddAt(at(25), 25); err != nil {
+		t.Fatal(err)
+	}
+	tbl.Close()
+
+	// open batches survive restart
+	if tbl, err = NewTimeSeriesTable(path, props); err != nil {
+		t.Fatal(err)
+	}
+	tbl.TopLevel().LateWindow = 15 * time.Second
+	for i := 30; i < 60; i++ {
+		if err := tbl.AddAt(at(i), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// late sample is read in chronological order
+	data, err := tbl.TopLevel().ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 59 || data[24].Val != 25 || !sort.IsSorted(DataPoints(data)) {
+		t.Fatalf("read %d data points out of order", len(data))
+	}
+	if data, err = tbl.TS[0].ReadAll(); err != nil {
+		t.Fatal(err)
+	}
+	// last two intervals are still within late window
+	if len(data) != 4 || data[1].Count != 9 || data[1].Val != 133.0/9 ||
+		data[2].Count != 10 || data[2].Val != 24.5 || data[2].Last != 29 {
+		t.Fatalf("unexpected roll-up of late samples %+v", data)
+	}
+}
+
+func TestGaps(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "TestGaps")
+	os.RemoveAll(path)
+
+	tbl, err := NewTimeSeriesTable(path, []TimeSeriesProps{{time.Second, 100 * time.Second, 0},
+		{10 * time.Second, 1000 * time.Second, AggMin | AggMax | AggCount}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tbl.Remove()
+	for i := 0; i < 40; i++ {
+		var dp = NewDataPoint(testStart.Add(time.Duration(i)*time.Second), float64(i))
+
+		// samples of second interval are partially and of third one completely missing
+		if (i >= 10 && i < 15) || (i >= 20 && i < 30) {
+			dp = NewGapDataPoint(dp.Tstamp)
+		}
+		if err := tbl.TopLevel().add(dp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if data, err := tbl.TopLevel().ReadAll(); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 40 || !data[10].IsGap() || data[15].IsGap() {
+		t.Fatalf("gaps not recorded %+v", data)
+	}
+	data, err := tbl.TS[0].ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gaps are ignored by roll-ups unless interval has no samples at all
+	if len(data) != 3 || data[1].Count != 5 || data[1].Min != 15 || data[1].Val != 17 ||
+		!data[2].IsGap() || !data[2].Tstamp.Equal(testStart.Add(20*time.Second)) {
+		t.Fatalf("unexpected roll-up of gaps %+v", data)
+	}
 }
@@ -0,0 +1,106 @@
+// Copyright (C) 2016, Heiko Koehler
+// units of property values and their formatting on chart axes
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// unit of property values
+type Unit struct {
+	// name shown in legends and page headers, empty if values have no unit
+	Name string
+	// format value including unit symbol, e.g. "1.5 GiB"
+	Format func(v float64) string
+}
+
+var (
+	binaryPrefixes  = []string{"", "Ki", "Mi", "Gi", "Ti", "Pi", "Ei"}
+	decimalPrefixes = []string{"", "k", "M", "G", "T", "P", "E"}
+	fractionUnits   = []string{"s", "ms", "µs", "ns"}
+)
+
+// format value with largest prefix keeping it at least 1
+func formatPrefixed(v, base float64, prefixes []string, symbol string) string {
+	var i int
+
+	for i = 0; i+1 < len(prefixes) && math.Abs(v) >= base; i++ {
+		v /= base
+	}
+	return fmt.Sprintf("%.4g %s%s", v, prefixes[i], symbol)
+}
+
+func formatNumber(v float64) string {
+	return fmt.Sprintf("%.4g", v)
+}
+
+func formatBytes(v float64) string {
+	return formatPrefixed(v, 1024, binaryPrefixes, "B")
+}
+
+func formatOps(v float64) string {
+	return formatPrefixed(v, 1000, decimalPrefixes, "ops")
+}
+
+// fractions of second are formatted as ms, µs or ns
+func formatSeconds(v float64) string {
+	var i int
+
+	for i = 0; i+1 < len(fractionUnits) && v != 0 && math.Abs(v) < 1; i++ {
+		v *= 1000
+	}
+	return fmt.Sprintf("%.4g %s", v, fractionUnits[i])
+}
+
+func formatPercent(v float64) string {
+	return fmt.Sprintf("%.4g%%", v)
+}
+
+// fraction between 0 and 1 shown as percentage
+func formatRatio(v float64) string {
+	return formatPercent(v * 100)
+}
+
+// known units by name
+var Units = map[string]Unit{
+	"":        {"", formatNumber},
+	"bytes":   {"bytes", formatBytes},
+	"seconds": {"seconds", formatSeconds},
+	"percent": {"percent", formatPercent},
+	"ratio":   {"ratio", formatRatio},
+	"ops":     {"ops", formatOps},
+	"bytes/s": Unit{"bytes", formatBytes}.Rate(),
+	"ops/s":   Unit{"ops", formatOps}.Rate(),
+}
+
+// look up unit by name
+func ParseUnit(name string) (Unit, error) {
+	if unit, ok := Units[strings.ToLower(name)]; ok {
+		return unit, nil
+	}
+	return Unit{}, errors.New(fmt.Sprintf("Unknown unit %s", name))
+}
+
+// unit of rate per second of values in unit, e.g. of counters
+func (unit Unit) Rate() Unit {
+	if unit.Name == "" {
+		return Unit{"1/s", func(v float64) string { return unit.Format(v) + "/s" }}
+	}
+	return Unit{unit.Name + "/s", func(v float64) string { return unit.Format(v) + "/s" }}
+}
+
+// Stringer interface
+func (unit Unit) String() string {
+	return unit.Name
+}
+
+// format axis tick of go-chart
+func (unit Unit) ValueFormatter(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return unit.Format(f)
+	}
+	return fmt.Sprintf("%v", v)
+}
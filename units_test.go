@@ -0,0 +1,76 @@
+// Copyright (C) 2016, Heiko Koehler
+
+package main
+
+import (
+	"testing"
+)
+
+func TestUnits(t *testing.T) {
+	var tests = []struct {
+		unit string
+		val  float64
+		str  string
+	}{
+		{"", 1234.5, "1234"},
+		{"bytes", 512, "512 B"},
+		{"bytes", 1536, "1.5 KiB"},
+		{"bytes", 3 * 1024 * 1024 * 1024, "3 GiB"},
+		{"bytes/s", 2048, "2 KiB/s"},
+		{"seconds", 90, "90 s"},
+		{"seconds", 0.25, "250 ms"},
+		{"seconds", 0, "0 s"},
+		{"percent", 42, "42%"},
+		{"ratio", 0.5, "50%"},
+		{"ops/s", 12000, "12 kops/s"},
+	}
+	for _, test := range tests {
+		unit, err := ParseUnit(test.unit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if str := unit.ValueFormatter(test.val); str != test.str {
+			t.Fatalf("%s formats %f as %s instead of %s", test.unit, test.val, str, test.str)
+		}
+	}
+	if _, err := ParseUnit("furlongs"); err == nil {
+		t.Fatal("accepted unknown unit")
+	}
+	if unit := Units["bytes"].Rate(); unit.Name != "bytes/s" {
+		t.Fatalf("unexpected rate unit %s", unit)
+	}
+}
+
+func TestPropertyUnits(t *testing.T) {
+	conf := HandlerConfig{Name: "Memory", URL: "/test/units", Cmd: "echo used 3 K",
+		Properties: []PropertyConfig{
+			{Name: "Used", Regex: "used (\\d+) K", Unit: "bytes", Scale: 1024},
+			{Name: "Percent", Expr: "Used / 1024", Unit: "percent"},
+		},
+		Charts: []ChartConfig{{Name: "Memory", Properties: []string{"Used", "Percent"}}},
+	}
+	if _, err := NewCommandHandler(conf); err == nil {
+		t.Fatal("accepted chart with mixed units")
+	}
+
+	conf.Charts[0].Properties = []string{"Used"}
+	handler, err := NewCommandHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, prop := range handler.(*CommandHandler).Properties {
+			prop.TS.Remove()
+		}
+	}()
+	handler.Execute()
+	for name, val := range map[string]float64{"Used": 3072, "Percent": 3} {
+		data, err := handler.(*CommandHandler).Properties[name].TS.TopLevel().ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 1 || data[0].Val != val {
+			t.Fatalf("unexpected data points of %s %+v", name, data)
+		}
+	}
+}